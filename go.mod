@@ -4,7 +4,10 @@ go 1.13
 
 require (
 	github.com/INFURA/go-ethlibs v0.0.0-20190906161005-7045fb26c40c
+	github.com/btcsuite/btcd v0.0.0-20190614013741-962a206e94e9
+	github.com/gorilla/websocket v1.4.1
 	github.com/jessevdk/go-flags v0.0.0-20141203071132-1679536dcc89
 	github.com/umbracle/go-web3 v0.0.0-20200107141429-b044b1dc2479
+	golang.org/x/crypto v0.0.0-20190829043050-9756ffdc2472
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 )
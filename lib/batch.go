@@ -0,0 +1,96 @@
+package ethspam
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+// Batch is a group of queries sent as a single JSONRPC batch request.
+type Batch []QueryContent
+
+// GetBody renders the batch as a JSON array on a single line.
+func (b Batch) GetBody() string {
+	return string(b.AppendBody(nil))
+}
+
+// Batcher groups queries into batches with sizes drawn from a weighted
+// distribution. Not goroutine-safe.
+type Batcher struct {
+	// PerMethod only groups queries generated by the same method together
+	PerMethod bool
+	RandSrc   rand.Source
+
+	sizes  []int // sorted asc
+	choice weightedChoice
+
+	pending map[string]Batch
+	targets map[string]int
+}
+
+// NewBatcher returns a Batcher for a map from batch size to its weight.
+func NewBatcher(sizes map[int]int64, perMethod bool, randSrc rand.Source) (*Batcher, error) {
+	b := &Batcher{
+		PerMethod: perMethod,
+		RandSrc:   randSrc,
+		pending:   map[string]Batch{},
+		targets:   map[string]int{},
+	}
+	for size := range sizes {
+		b.sizes = append(b.sizes, size)
+	}
+	sort.Ints(b.sizes)
+	for _, size := range b.sizes {
+		weight := sizes[size]
+		if size < 1 {
+			return nil, errors.New("batch sizes must be at least 1")
+		}
+		if weight < 0 {
+			return nil, errors.New("batch size weights must not be negative")
+		}
+		b.choice.add(weight)
+	}
+	if b.choice.totalWeight == 0 {
+		return nil, errors.New("no batch sizes with a positive weight")
+	}
+	return b, nil
+}
+
+// Add appends the query to a pending batch and returns the batch once it
+// reaches its size, or nil while it is still filling up.
+func (b *Batcher) Add(q QueryContent) Batch {
+	key := ""
+	if b.PerMethod {
+		key = q.Name
+	}
+	target, ok := b.targets[key]
+	if !ok {
+		target = b.sizes[b.choice.pick(b.RandSrc.Int63)]
+		b.targets[key] = target
+	}
+	batch := append(b.pending[key], q)
+	if len(batch) < target {
+		b.pending[key] = batch
+		return nil
+	}
+	delete(b.pending, key)
+	delete(b.targets, key)
+	return batch
+}
+
+// Flush returns the batches still filling up, such as when the queries run
+// out, and empties the Batcher.
+func (b *Batcher) Flush() []Batch {
+	keys := make([]string, 0, len(b.pending))
+	for key := range b.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	batches := make([]Batch, len(keys))
+	for i, key := range keys {
+		batches[i] = b.pending[key]
+	}
+	b.pending = map[string]Batch{}
+	b.targets = map[string]int{}
+	return batches
+}
@@ -0,0 +1,124 @@
+package ethspam
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"text/tabwriter"
+)
+
+// Comparison checks that two endpoints return the same results for the same
+// queries and reports any mismatches. Goroutine-safe.
+type Comparison struct {
+	mu      sync.Mutex
+	out     io.Writer
+	methods map[string]*comparisonCount
+}
+
+type comparisonCount struct {
+	compared   int64
+	mismatched int64
+	failed     int64
+}
+
+// mismatch is written as one JSON line per differing query.
+type mismatch struct {
+	Method   string          `json:"method"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response"`
+	Compare  json.RawMessage `json:"compare"`
+}
+
+// NewComparison returns a Comparison that writes mismatches to out.
+func NewComparison(out io.Writer) *Comparison {
+	return &Comparison{
+		out:     out,
+		methods: map[string]*comparisonCount{},
+	}
+}
+
+// Record compares the responses of both endpoints to the query, writing the
+// query and both responses to the output if they differ. compareErr is the
+// error of sending the query to the compare endpoint: queries it failed
+// without a response, or whose responses can't be decoded, are counted as
+// failed. The returned error is from writing to the output.
+func (c *Comparison) Record(q QueryContent, response, compare []byte, compareErr error) error {
+	equal, err := false, compareErr
+	if hasResponse(compareErr) {
+		equal, err = equalResponses(response, compare)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count, ok := c.methods[q.Name]
+	if !ok {
+		count = &comparisonCount{}
+		c.methods[q.Name] = count
+	}
+	if err != nil {
+		count.failed++
+		return nil
+	}
+	count.compared++
+	if equal {
+		return nil
+	}
+	count.mismatched++
+
+	line, err := json.Marshal(mismatch{
+		Method:   q.Name,
+		Request:  json.RawMessage(q.GetBody()),
+		Response: json.RawMessage(response),
+		Compare:  json.RawMessage(compare),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(c.out, "%s\n", line)
+	return err
+}
+
+// equalResponses reports whether two JSONRPC responses carry the same result,
+// ignoring ids and formatting. Two errors are considered equal regardless of
+// their codes and messages, which differ between client implementations.
+func equalResponses(a, b []byte) (bool, error) {
+	var replyA, replyB struct {
+		Result interface{} `json:"result"`
+		Error  *RPCError   `json:"error"`
+	}
+	if err := json.Unmarshal(a, &replyA); err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, &replyB); err != nil {
+		return false, err
+	}
+	if replyA.Error != nil || replyB.Error != nil {
+		return replyA.Error != nil && replyB.Error != nil, nil
+	}
+	return reflect.DeepEqual(replyA.Result, replyB.Result), nil
+}
+
+// WriteTable writes a summary table of compared, mismatched and failed
+// queries per method.
+func (c *Comparison) WriteTable(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	methods := make([]string, 0, len(c.methods))
+	for method := range c.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "method\tcompared\tmismatched\tfailed\t")
+	for _, method := range methods {
+		count := c.methods[method]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t\n", method, count.compared, count.mismatched, count.failed)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,175 @@
+package ethspam
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/INFURA/go-ethlibs/eth"
+	"github.com/INFURA/go-ethlibs/node"
+)
+
+// Limits on contract discovery
+const (
+	// DefaultReceiptSamples is the number of receipts fetched per new block
+	DefaultReceiptSamples = 8
+	// maxContracts is how many of the most active contracts the state samples
+	maxContracts = 50
+	// maxTrackedContracts bounds the activity table between refreshes
+	maxTrackedContracts = 1000
+	// activityDecay ages out the activity of a contract on every refresh
+	activityDecay = 0.9
+	// minActivity is the score below which a contract is forgotten
+	minActivity = 0.05
+	// maxReceiptRequests bounds the receipts fetched at once
+	maxReceiptRequests = 16
+)
+
+// contractActivity is the decayed count of calls and events of a contract.
+type contractActivity struct {
+	score  float64
+	events map[string]float64 // topic0 to its score
+}
+
+// activityTable ranks contracts by their activity in recent receipts.
+// Immutable once built, refreshes derive a new table.
+type activityTable map[string]contractActivity
+
+// decayed returns a copy of the table with every score aged by one refresh,
+// dropping contracts and events that fell below minActivity.
+func (t activityTable) decayed() activityTable {
+	next := make(activityTable, len(t))
+	for addr, a := range t {
+		score := a.score * activityDecay
+		if score < minActivity {
+			continue
+		}
+		events := make(map[string]float64, len(a.events))
+		for topic, s := range a.events {
+			if s *= activityDecay; s >= minActivity {
+				events[topic] = s
+			}
+		}
+		next[addr] = contractActivity{score: score, events: events}
+	}
+	return next
+}
+
+func (t activityTable) add(addr string, topic string) {
+	a, ok := t[addr]
+	if !ok {
+		a.events = map[string]float64{}
+	}
+	a.score++
+	if topic != "" {
+		a.events[topic]++
+	}
+	t[addr] = a
+}
+
+// observe counts the callee and the log emitters of the receipt.
+func (t activityTable) observe(r *eth.TransactionReceipt) {
+	if r.To != nil && len(r.Logs) > 0 {
+		// Only calls that emit events are known to hit a contract
+		t.add(r.To.String(), "")
+	}
+	for _, log := range r.Logs {
+		topic := ""
+		if len(log.Topics) > 0 {
+			topic = string(log.Topics[0])
+		}
+		t.add(log.Address.String(), topic)
+	}
+}
+
+// ranked returns the n most active contracts, each with its most frequent
+// event signature as the topic.
+func (t activityTable) ranked(n int) []Contract {
+	addrs := make([]string, 0, len(t))
+	for addr := range t {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		if t[addrs[i]].score != t[addrs[j]].score {
+			return t[addrs[i]].score > t[addrs[j]].score
+		}
+		return addrs[i] < addrs[j]
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+
+	contracts := make([]Contract, 0, len(addrs))
+	for _, addr := range addrs {
+		c := Contract{Addr: addr}
+		if topic := topEvent(t[addr].events); topic != "" {
+			c.Topics = []string{topic}
+		}
+		contracts = append(contracts, c)
+	}
+	return contracts
+}
+
+// trimmed drops the least active contracts beyond n.
+func (t activityTable) trimmed(n int) activityTable {
+	if len(t) <= n {
+		return t
+	}
+	keep := activityTable{}
+	for _, c := range t.ranked(n) {
+		keep[c.Addr] = t[c.Addr]
+	}
+	return keep
+}
+
+func topEvent(events map[string]float64) (top string) {
+	var best float64
+	for topic, score := range events {
+		if score > best || (score == best && topic < top) {
+			top, best = topic, score
+		}
+	}
+	return top
+}
+
+// observeReceipts fetches up to n receipts spread over each of the blocks and
+// counts them in the table. Receipts are fetched concurrently, so discovery
+// costs the refresh about one round trip. Discovery is best effort, failed
+// receipts are skipped.
+func observeReceipts(client node.Client, table activityTable, blocks []*eth.Block, n int) {
+	var hashes []string
+	for _, b := range blocks {
+		txs := b.Transactions
+		samples := n
+		if samples > len(txs) {
+			samples = len(txs)
+		}
+		for i := 0; i < samples; i++ {
+			hashes = append(hashes, txs[i*len(txs)/samples].Transaction.Hash.String())
+		}
+	}
+
+	receipts := make([]*eth.TransactionReceipt, len(hashes))
+	sem := make(chan struct{}, maxReceiptRequests)
+	var wg sync.WaitGroup
+	for i, hash := range hashes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, hash string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r, err := client.TransactionReceipt(context.Background(), hash)
+			if err == nil {
+				receipts[i] = r
+			}
+		}(i, hash)
+	}
+	wg.Wait()
+
+	// Counted in order, so the ranking doesn't depend on response timing
+	for _, r := range receipts {
+		if r != nil {
+			table.observe(r)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package ethspam
+
+// tracerMix returns the trace configs of debug_trace* queries, weighted by
+// the tracers.
+func tracerMix(tracers []Tracer) weightedParams {
+	var mix weightedParams
+	for _, t := range tracers {
+		mix.add(string(t.Config), t.Weight)
+	}
+	return mix
+}
+
+func genDebugTraceTransaction(p MethodProfile) Generator {
+	mix := tracerMix(p.Tracers)
+	return func(s State) QueryContent {
+		hash := s.RandomTransaction()
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "debug_traceTransaction",
+			Params: `["` + hash + `",` + mix.pick(s) + `]`,
+		}
+	}
+}
+
+func genDebugTraceBlockByNumber(p MethodProfile) Generator {
+	mix := tracerMix(p.Tracers)
+	return func(s State) QueryContent {
+		block := behind(s.CurrentBlock(), uint64(s.RandInt64()%1000))
+		var buf [512]byte
+		b := append(buf[:0], '[')
+		b = appendQuantity(b, block)
+		b = append(b, ',')
+		b = append(b, mix.pick(s)...)
+		b = append(b, ']')
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "debug_traceBlockByNumber",
+			Params: string(b),
+		}
+	}
+}
+
+func genDebugTraceBlockByHash(p MethodProfile) Generator {
+	mix := tracerMix(p.Tracers)
+	return func(s State) QueryContent {
+		hash := s.RandomBlock()
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "debug_traceBlockByHash",
+			Params: `["` + hash + `",` + mix.pick(s) + `]`,
+		}
+	}
+}
+
+func genDebugTraceCall(p MethodProfile) Generator {
+	mix := tracerMix(p.Tracers)
+	return func(s State) QueryContent {
+		to, from, input, block := s.RandomCall()
+		var buf [1024]byte
+		b := append(buf[:0], '[')
+		b = appendCall(b, to, from, input)
+		b = append(b, ',')
+		b = appendQuantity(b, block-1)
+		b = append(b, ',')
+		b = append(b, mix.pick(s)...)
+		b = append(b, ']')
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "debug_traceCall",
+			Params: string(b),
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ethspam
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Driver sends generated queries to a Target from a fixed pool of workers.
+type Driver struct {
+	Target      *Target
+	Concurrency int
+	Stats       *Stats
+
+	// Compare, when set, is sent every query as well and its responses are
+	// checked against the ones from Target by Comparison.
+	Compare    *Target
+	Comparison *Comparison
+}
+
+// Run sends queries until the channel is closed or the context is cancelled.
+// It stops early and returns the error if mismatches can't be written.
+func (d *Driver) Run(ctx context.Context, queries <-chan QueryContent) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var runErr error
+	for i := 0; i < d.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range queries {
+				ok, err := d.send(ctx, q)
+				if err != nil {
+					once.Do(func() {
+						runErr = err
+						cancel()
+					})
+				}
+				if !ok {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return runErr
+}
+
+// send returns false once the context is cancelled, or with the error of
+// recording the comparison.
+func (d *Driver) send(ctx context.Context, q QueryContent) (bool, error) {
+	start := time.Now()
+	response, err := d.Target.Send(ctx, q)
+	if ctx.Err() != nil {
+		// Interrupted mid-flight, not the endpoint's fault
+		return false, nil
+	}
+	d.Stats.Record(q.Name, time.Since(start), err)
+	if q.Responder != nil {
+		q.Answer(responseResult(response), err)
+	}
+
+	if d.Compare == nil || !hasResponse(err) || !comparable(q) {
+		return true, nil
+	}
+	compare, err := d.Compare.Send(ctx, q)
+	if ctx.Err() != nil {
+		return false, nil
+	}
+	if err := d.Comparison.Record(q, response, compare, err); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// comparable reports whether a query is sent to Compare as well. Scenario
+// steps answer their responses from Target to the next steps, filter ids
+// are only valid on the endpoint that installed them, and sent transactions
+// would be broadcast twice.
+func comparable(q QueryContent) bool {
+	return q.Responder == nil && !filterMethods[q.Method] && !runtimeMethods[q.Method]
+}
+
+// hasResponse reports whether a Target.Send error still came with a valid
+// JSONRPC response body.
+func hasResponse(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, ok := err.(*RPCError)
+	return ok
+}
+
+// responseResult returns the result of a JSONRPC response body, or nil if it
+// has none.
+func responseResult(body []byte) json.RawMessage {
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if json.Unmarshal(body, &reply) != nil {
+		return nil
+	}
+	return reply.Result
+}
@@ -0,0 +1,176 @@
+package ethspam
+
+import (
+	"container/heap"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxFilters bounds the filters installed at once. Past it, the filter due
+// soonest is polled early instead of installing another.
+const maxFilters = 10000
+
+// filterMethods are the methods of the filter lifecycle, all generated by the
+// filters entry of a profile.
+var filterMethods = map[string]bool{
+	"eth_newFilter":                   true,
+	"eth_newBlockFilter":              true,
+	"eth_newPendingTransactionFilter": true,
+	"eth_getFilterChanges":            true,
+	"eth_getFilterLogs":               true,
+	"eth_uninstallFilter":             true,
+}
+
+// FilterSessions generates the queries of dApps that poll with filters: a
+// filter is installed, polled every PollInterval with the filter ID returned
+// by the endpoint, and eventually uninstalled, or abandoned to expire on the
+// endpoint. Filters are installed whenever none is due, so the number of
+// active filters settles where their polls match the rate of the generator.
+// Goroutine-safe, and shared by all the states.
+type FilterSessions struct {
+	PollInterval time.Duration
+	// Polls is the mean number of polls before a filter is dropped
+	Polls int
+	Mix   FilterMix
+
+	mu  sync.Mutex
+	due filterQueue
+}
+
+// NewFilterSessions returns the FilterSessions of the method profile, with
+// defaults for unset tunables.
+func NewFilterSessions(p MethodProfile) *FilterSessions {
+	p = p.withDefaults()
+	return &FilterSessions{
+		PollInterval: time.Duration(p.PollInterval),
+		Polls:        p.Polls,
+		Mix:          *p.FilterMix,
+	}
+}
+
+// Generate returns the next poll or uninstall of a filter that is due, or
+// installs a new filter.
+func (f *FilterSessions) Generate(s State) QueryContent {
+	for {
+		f.mu.Lock()
+		var filter *sessionFilter
+		if len(f.due) > 0 && (len(f.due) >= maxFilters || !f.due[0].due.After(time.Now())) {
+			filter = heap.Pop(&f.due).(*sessionFilter)
+		}
+		f.mu.Unlock()
+
+		if filter == nil {
+			return f.install(s)
+		}
+		if filter.polls > 0 {
+			filter.polls--
+			return filter.poll(s)
+		}
+		if !chance(s, f.Mix.Leak) {
+			return filter.query(s, "eth_uninstallFilter", nil)
+		}
+		// Leaked, the endpoint expires it eventually
+	}
+}
+
+func (f *FilterSessions) install(s State) QueryContent {
+	filter := &sessionFilter{sessions: f, kind: "eth_newFilter"}
+	switch r := float64(s.RandInt64()%1000000) / 1000000; {
+	case r < f.Mix.Block:
+		filter.kind = "eth_newBlockFilter"
+	case r < f.Mix.Block+f.Mix.PendingTransaction:
+		filter.kind = "eth_newPendingTransactionFilter"
+	}
+	filter.polls = 1 + int(s.RandInt64()%int64(2*f.Polls))
+
+	q := QueryContent{
+		Id:        s.ID(),
+		Method:    filter.kind,
+		Params:    "[]",
+		Name:      filter.kind,
+		Responder: filter,
+	}
+	if filter.kind == "eth_newFilter" {
+		addr, topics := s.RandomContract()
+		var arr [256]byte
+		b := append(arr[:0], `[{"address":`...)
+		b = appendString(b, addr)
+		if len(topics) > 0 {
+			b = append(b, `,"topics":[`...)
+			b = appendString(b, topics[0])
+			b = append(b, ']')
+		}
+		q.Params = string(append(b, "}]"...))
+	}
+	return q
+}
+
+// sessionFilter is a filter of a FilterSessions, from its install until it is
+// dropped. It is answered the responses to its own queries.
+type sessionFilter struct {
+	sessions *FilterSessions
+	kind     string // the method that installed it
+	id       string
+	polls    int // left before the filter is dropped
+	due      time.Time
+}
+
+func (filter *sessionFilter) poll(s State) QueryContent {
+	method := "eth_getFilterChanges"
+	if filter.kind == "eth_newFilter" && chance(s, filter.sessions.Mix.FilterLogs) {
+		method = "eth_getFilterLogs"
+	}
+	return filter.query(s, method, filter)
+}
+
+func (filter *sessionFilter) query(s State, method string, responder Responder) QueryContent {
+	return QueryContent{
+		Id:        s.ID(),
+		Method:    method,
+		Params:    stringParams(filter.id),
+		Name:      method,
+		Responder: responder,
+	}
+}
+
+// Respond schedules the next poll of the filter. Filters that failed to
+// install or to poll, such as ones the endpoint expired, are dropped.
+// Installs without a result, such as printed queries, get an ID made up
+// from the query ID.
+func (filter *sessionFilter) Respond(q QueryContent, result json.RawMessage, err error) {
+	if err != nil {
+		return
+	}
+	if q.Method == filter.kind {
+		if json.Unmarshal(result, &filter.id) != nil || filter.id == "" {
+			filter.id = "0x" + strconv.FormatInt(q.Id, 16)
+		}
+	}
+
+	f := filter.sessions
+	f.mu.Lock()
+	filter.due = time.Now().Add(f.PollInterval)
+	heap.Push(&f.due, filter)
+	f.mu.Unlock()
+}
+
+// filterQueue is a heap of filters by their next poll.
+type filterQueue []*sessionFilter
+
+func (q filterQueue) Len() int           { return len(q) }
+func (q filterQueue) Less(i, j int) bool { return q[i].due.Before(q[j].due) }
+func (q filterQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+func (q *filterQueue) Push(x interface{}) {
+	*q = append(*q, x.(*sessionFilter))
+}
+
+func (q *filterQueue) Pop() interface{} {
+	old := *q
+	filter := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return filter
+}
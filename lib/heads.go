@@ -0,0 +1,172 @@
+package ethspam
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/INFURA/go-ethlibs/node"
+)
+
+// HeadFollower paces state refreshes to the chain. It follows a newHeads
+// subscription when the client supports one, and otherwise polls at the block
+// time observed between refreshes, so fast chains are tracked block by block
+// without wasting calls on slow ones. Not goroutine-safe.
+type HeadFollower struct {
+	// MinInterval and MaxInterval bound the polling interval
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	sub       node.Subscription
+	blockTime time.Duration
+	lastBlock uint64
+	lastSeen  time.Time
+}
+
+// NewHeadFollower returns a HeadFollower that subscribes to newHeads if the
+// client is bidirectional, such as a WebSocket client, and otherwise starts
+// polling at the given interval until a block time is observed.
+func NewHeadFollower(ctx context.Context, client node.Client, interval time.Duration) *HeadFollower {
+	h := &HeadFollower{
+		MinInterval: 250 * time.Millisecond,
+		MaxInterval: interval,
+		blockTime:   interval,
+	}
+	if client.IsBidirectional() {
+		if sub, err := client.SubscribeNewHeads(ctx); err == nil {
+			h.sub = sub
+		}
+	}
+	return h
+}
+
+// Subscribed reports whether heads are followed with a subscription.
+func (h *HeadFollower) Subscribed() bool {
+	return h.sub != nil
+}
+
+// Observe updates the block time estimate with the current block of a
+// refreshed state.
+func (h *HeadFollower) Observe(block uint64) {
+	now := time.Now()
+	if h.lastBlock != 0 && block > h.lastBlock {
+		sample := now.Sub(h.lastSeen) / time.Duration(block-h.lastBlock)
+		// Smooth out the jitter of individual blocks
+		h.blockTime = (3*h.blockTime + sample) / 4
+	}
+	if block > h.lastBlock {
+		h.lastBlock = block
+		h.lastSeen = now
+	}
+}
+
+// Interval returns the current polling interval.
+func (h *HeadFollower) Interval() time.Duration {
+	interval := h.blockTime
+	if interval < h.MinInterval {
+		interval = h.MinInterval
+	}
+	if interval > h.MaxInterval {
+		interval = h.MaxInterval
+	}
+	return interval
+}
+
+// Wait blocks until a new head is announced, or until the next block is
+// expected when polling. A failed subscription falls back to polling.
+func (h *HeadFollower) Wait(ctx context.Context) error {
+	if h.sub != nil {
+		select {
+		case <-h.sub.Ch():
+			// Heads that piled up meanwhile are covered by the next refresh
+			for {
+				select {
+				case <-h.sub.Ch():
+					continue
+				default:
+				}
+				return nil
+			}
+		case <-h.sub.Done():
+			err := h.sub.Err()
+			h.sub = nil
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	select {
+	case <-time.After(h.Interval()):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Bounds of the blocks a headClock remembers
+const (
+	maxSeenHeads  = 256
+	maxEarlyHeads = 1024
+)
+
+// headClock records when the state first saw each block, to time the newHeads
+// notifications of an endpoint against it. Goroutine-safe.
+type headClock struct {
+	mu    sync.Mutex
+	seen  []headTime // by ascending block
+	early []headTime // notified before the state saw them
+}
+
+type headTime struct {
+	block uint64
+	at    time.Time
+}
+
+// see records the current block of a new state, returning how long before it
+// the early notifications of this block and any below it came in.
+func (c *headClock) see(block uint64, now time.Time) []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.seen) == 0 || block > c.seen[len(c.seen)-1].block {
+		c.seen = append(c.seen, headTime{block, now})
+		if len(c.seen) > maxSeenHeads {
+			c.seen = append(c.seen[:0], c.seen[len(c.seen)-maxSeenHeads:]...)
+		}
+	}
+
+	var leads []time.Duration
+	early := c.early[:0]
+	for _, h := range c.early {
+		if h.block <= block {
+			leads = append(leads, now.Sub(h.at))
+		} else {
+			early = append(early, h)
+		}
+	}
+	c.early = early
+	return leads
+}
+
+// notify returns how long after the state the block was notified. Blocks
+// the state hasn't seen yet are kept until it does and ok is false. When too
+// many are kept, the oldest are dropped and their leads so far returned.
+func (c *headClock) notify(block uint64, now time.Time) (lag time.Duration, ok bool, dropped []time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A block skipped over by the state, such as while it caught up, was
+	// known to it by the time it saw the next one
+	i := sort.Search(len(c.seen), func(i int) bool { return c.seen[i].block >= block })
+	if i < len(c.seen) {
+		return now.Sub(c.seen[i].at), true, nil
+	}
+	c.early = append(c.early, headTime{block, now})
+	for len(c.early) > maxEarlyHeads {
+		dropped = append(dropped, now.Sub(c.early[0].at))
+		c.early = c.early[1:]
+	}
+	return 0, false, dropped
+}
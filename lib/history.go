@@ -0,0 +1,151 @@
+package ethspam
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/INFURA/go-ethlibs/eth"
+	"github.com/INFURA/go-ethlibs/node"
+)
+
+// DefaultHistoryBlocks is the number of blocks a HistoryProducer samples
+const DefaultHistoryBlocks = 100
+
+// HistoricalState implements State over blocks sampled from a historical
+// range, so queries hit cold archive data instead of the tip. Every query is
+// anchored at its own height: CurrentBlock is redrawn from the range before
+// each query is generated, and queries of the current chain state are made at
+// that height instead of "latest".
+type HistoricalState struct {
+	*LiveState
+
+	FromBlock uint64
+	ToBlock   uint64
+	// Curve shapes the sampling of heights: 1 is uniform over the range,
+	// above 1 favors older blocks and below 1 recent ones
+	Curve float64
+
+	anchor uint64
+}
+
+func (s *HistoricalState) Fork(randSrc rand.Source) State {
+	fork := *s
+	fork.LiveState = s.LiveState.fork(randSrc)
+	return &fork
+}
+
+// drawAnchor implements anchoredState.
+func (s *HistoricalState) drawAnchor() {
+	s.anchor = s.RandomHeight()
+}
+
+// anchorTag implements anchoredState.
+func (s *HistoricalState) anchorTag() string {
+	return "0x" + strconv.FormatUint(s.anchor, 16)
+}
+
+func (s *HistoricalState) CurrentBlock() uint64 {
+	return s.anchor
+}
+
+// RandomHeight returns a block number from the range, distributed by the
+// curve.
+func (s *HistoricalState) RandomHeight() uint64 {
+	return sampleHeight(s.RandSrc, s.FromBlock, s.ToBlock, s.Curve)
+}
+
+func sampleHeight(randSrc rand.Source, from, to uint64, curve float64) uint64 {
+	if to <= from {
+		return from
+	}
+	u := float64(randSrc.Int63()) / (1 << 63)
+	if curve > 0 && curve != 1 {
+		u = math.Pow(u, curve)
+	}
+	n := from + uint64(u*float64(to-from+1))
+	if n > to {
+		// Rounding at the top of large ranges
+		n = to
+	}
+	return n
+}
+
+// HistoryProducer samples a HistoricalState from a block range. The blocks
+// are fetched once, historical states are never refreshed.
+type HistoryProducer struct {
+	Client    node.Client
+	FromBlock uint64
+	// ToBlock is the last block of the range, the latest block if zero
+	ToBlock uint64
+	Curve   float64
+	// Blocks is the number of blocks fetched for hashes, transactions and
+	// addresses, DefaultHistoryBlocks if zero
+	Blocks int
+	// Contracts are the contracts to sample, such as the list for the
+	// network from NetworkContracts
+	Contracts []Contract
+}
+
+// Produce fetches the sampled blocks, drawing their heights from randSrc so
+// that seeded runs sample the same blocks.
+func (p *HistoryProducer) Produce(ctx context.Context, randSrc rand.Source) (*HistoricalState, error) {
+	to := p.ToBlock
+	if to == 0 {
+		latest, err := p.Client.BlockNumber(ctx)
+		if err != nil {
+			return nil, err
+		}
+		to = latest
+	}
+	if to < p.FromBlock {
+		return nil, errors.New("the historical range ends before it starts")
+	}
+	count := p.Blocks
+	if count == 0 {
+		count = DefaultHistoryBlocks
+	}
+
+	blockHashes := map[uint64]string{}
+	txs := []eth.Transaction{}
+	for i := 0; i < count; i++ {
+		n := sampleHeight(randSrc, p.FromBlock, to, p.Curve)
+		if _, ok := blockHashes[n]; ok {
+			continue
+		}
+		b, err := p.Client.BlockByNumber(ctx, n, true)
+		if err != nil {
+			return nil, err
+		}
+		blockHashes[n] = b.Hash.String()
+		for _, tx := range b.Transactions {
+			// Only take 0-value transactions, hopefully these are all contract calls.
+			if tx.Transaction.Value.Int64() == 0 {
+				txs = append(txs, tx.Transaction)
+			}
+		}
+	}
+	if len(txs) == 0 {
+		// Early mainnet blocks are mostly empty
+		return nil, errors.New("no transactions in the sampled blocks, widen the range or sample more blocks")
+	}
+
+	return &HistoricalState{
+		LiveState: &LiveState{
+			IdGen:   &IdGenerator{},
+			RandSrc: randSrc,
+
+			currentBlock: to,
+			transactions: txs,
+			blockHashes:  blockHashes,
+			blocks:       sortedBlocks(blockHashes),
+			known:        p.Contracts,
+		},
+		FromBlock: p.FromBlock,
+		ToBlock:   to,
+		Curve:     p.Curve,
+		anchor:    sampleHeight(randSrc, p.FromBlock, to, p.Curve),
+	}, nil
+}
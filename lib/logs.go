@@ -0,0 +1,127 @@
+package ethspam
+
+import (
+	"math"
+	"strings"
+)
+
+// logTags are the block tags of filters that poll the tip
+var logTags = []string{"latest", "safe", "finalized"}
+
+// chance reports whether an event of probability p happens.
+func chance(s State, p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	return float64(s.RandInt64()%1000000) < p*1000000
+}
+
+// paretoRange returns a block range size of at least 1 from a Pareto
+// distribution with the given shape, capped at max.
+func paretoRange(s State, alpha float64, max uint64) uint64 {
+	u := float64(s.RandInt64()+1) / (1 << 63)
+	size := math.Pow(u, -1/alpha)
+	if size >= float64(max) {
+		return max
+	}
+	return uint64(size)
+}
+
+// appendLogFilter appends an eth_getLogs filter object in one of the shapes
+// of the method profile.
+func appendLogFilter(b []byte, s State, p MethodProfile) []byte {
+	f := p.Filters
+	b = append(b, '{')
+
+	switch {
+	case chance(s, f.BlockHash):
+		b = append(b, `"blockHash":`...)
+		b = appendString(b, s.RandomBlock())
+	case chance(s, f.Tag):
+		tag := logTags[s.RandInt64()%int64(len(logTags))]
+		b = append(b, `"fromBlock":`...)
+		b = appendString(b, tag)
+		b = append(b, `,"toBlock":`...)
+		b = appendString(b, tag)
+	default:
+		// Most ranges are short and end near the tip
+		toBlock := behind(s.CurrentBlock(), uint64(s.RandInt64())%p.Recency)
+		fromBlock := behind(toBlock, paretoRange(s, p.RangeAlpha, p.BlockRange)-1)
+		b = append(b, `"fromBlock":`...)
+		b = appendQuantity(b, fromBlock)
+		b = append(b, `,"toBlock":`...)
+		b = appendQuantity(b, toBlock)
+	}
+
+	address, topics := s.RandomContract()
+	switch {
+	case chance(s, f.NoAddress):
+	case chance(s, f.AddressArray):
+		b = append(b, `,"address":[`...)
+		b = appendString(b, address)
+		for n := 2 + s.RandInt64()%3; n > 1; n-- {
+			other, _ := s.RandomContract()
+			b = append(b, ',')
+			b = appendString(b, other)
+		}
+		b = append(b, ']')
+	default:
+		b = append(b, `,"address":`...)
+		b = appendString(b, address)
+	}
+
+	switch {
+	case chance(s, f.NoTopics):
+	case chance(s, f.Wildcard):
+		// Any event with the account as the first indexed argument
+		addr := strings.TrimPrefix(s.RandomAddress(), "0x")
+		b = append(b, `,"topics":[null,"0x`...)
+		for i := len(addr); i < 64; i++ {
+			b = append(b, '0')
+		}
+		b = append(b, addr...)
+		b = append(b, `"]`...)
+	case chance(s, f.TopicOr):
+		var arr [4]string
+		signatures := eventSignatures(arr[:0], s, 2+int(s.RandInt64()%3))
+		if len(signatures) > 0 {
+			b = append(b, `,"topics":[[`...)
+			for i, signature := range signatures {
+				if i > 0 {
+					b = append(b, ',')
+				}
+				b = appendString(b, signature)
+			}
+			b = append(b, `]]`...)
+		}
+	default:
+		if len(topics) > 0 {
+			b = append(b, `,"topics":[`...)
+			b = appendString(b, topics[0])
+			b = append(b, ']')
+		}
+	}
+
+	return append(b, '}')
+}
+
+// eventSignatures appends the distinct first topics of up to n random
+// contracts to dst.
+func eventSignatures(dst []string, s State, n int) []string {
+	for i := 0; i < n; i++ {
+		_, topics := s.RandomContract()
+		if len(topics) > 0 && !contains(dst, topics[0]) {
+			dst = append(dst, topics[0])
+		}
+	}
+	return dst
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package ethspam
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Latency bucket bounds exported for request duration histograms
+var metricsBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Metrics tracks generation and state statistics and serves them, along with
+// the send results in Stats, in the Prometheus text exposition format.
+// Goroutine-safe.
+type Metrics struct {
+	// Stats holds the results of sent queries, nil when not sending
+	Stats *Stats
+
+	mu           sync.Mutex
+	generated    map[string]int64
+	refreshes    int64
+	emptyBlocks  int64
+	reorgs       int64
+	currentBlock uint64
+	transactions int
+	blockHashes  int
+}
+
+// NewMetrics returns empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		generated: map[string]int64{},
+	}
+}
+
+// Generated counts a generated query, keyed by the generating method.
+func (m *Metrics) Generated(method string) {
+	m.mu.Lock()
+	m.generated[method]++
+	m.mu.Unlock()
+}
+
+// Refreshed counts a successful state refresh and samples the new state.
+func (m *Metrics) Refreshed(state *LiveState) {
+	transactions, blockHashes := state.Size()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refreshes++
+	m.reorgs = state.Reorgs()
+	m.currentBlock = state.CurrentBlock()
+	m.transactions = transactions
+	m.blockHashes = blockHashes
+}
+
+// EmptyBlock counts a refresh that was skipped with ErrEmptyBlock.
+func (m *Metrics) EmptyBlock() {
+	m.mu.Lock()
+	m.emptyBlocks++
+	m.mu.Unlock()
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	ew := &errWriter{w: w}
+
+	m.mu.Lock()
+	ew.printf("# HELP ethspam_queries_generated_total Queries generated per method.\n")
+	ew.printf("# TYPE ethspam_queries_generated_total counter\n")
+	for _, method := range sortedKeys(m.generated) {
+		ew.printf("ethspam_queries_generated_total{method=%q} %d\n", method, m.generated[method])
+	}
+	ew.printf("# HELP ethspam_state_refreshes_total State refreshes performed.\n")
+	ew.printf("# TYPE ethspam_state_refreshes_total counter\n")
+	ew.printf("ethspam_state_refreshes_total %d\n", m.refreshes)
+	ew.printf("# HELP ethspam_empty_blocks_total State refreshes skipped because the latest block was empty.\n")
+	ew.printf("# TYPE ethspam_empty_blocks_total counter\n")
+	ew.printf("ethspam_empty_blocks_total %d\n", m.emptyBlocks)
+	ew.printf("# HELP ethspam_reorgs_total Chain reorganizations detected while refreshing the state.\n")
+	ew.printf("# TYPE ethspam_reorgs_total counter\n")
+	ew.printf("ethspam_reorgs_total %d\n", m.reorgs)
+	ew.printf("# HELP ethspam_current_block Latest block number of the state.\n")
+	ew.printf("# TYPE ethspam_current_block gauge\n")
+	ew.printf("ethspam_current_block %d\n", m.currentBlock)
+	ew.printf("# HELP ethspam_state_transactions Transactions in the state pool.\n")
+	ew.printf("# TYPE ethspam_state_transactions gauge\n")
+	ew.printf("ethspam_state_transactions %d\n", m.transactions)
+	ew.printf("# HELP ethspam_state_block_hashes Block hashes in the state pool.\n")
+	ew.printf("# TYPE ethspam_state_block_hashes gauge\n")
+	ew.printf("ethspam_state_block_hashes %d\n", m.blockHashes)
+	m.mu.Unlock()
+
+	if m.Stats != nil {
+		m.Stats.writeMetrics(ew)
+	}
+	return ew.n, ew.err
+}
+
+func (s *Stats) writeMetrics(ew *errWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	methods := make([]string, 0, len(s.methods))
+	for method := range s.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	ew.printf("# HELP ethspam_request_duration_seconds Latency of sent queries per method.\n")
+	ew.printf("# TYPE ethspam_request_duration_seconds histogram\n")
+	for _, method := range methods {
+		m := s.methods[method]
+		h := &m.Latency
+		for i, bound := range metricsBuckets {
+			ew.printf("ethspam_request_duration_seconds_bucket{method=%q,le=%q} %d\n", method, fmt.Sprint(bound.Seconds()), m.le[i])
+		}
+		ew.printf("ethspam_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.total)
+		ew.printf("ethspam_request_duration_seconds_sum{method=%q} %f\n", method, h.sum.Seconds())
+		ew.printf("ethspam_request_duration_seconds_count{method=%q} %d\n", method, h.total)
+	}
+	ew.printf("# HELP ethspam_request_errors_total Failed queries per method and error code.\n")
+	ew.printf("# TYPE ethspam_request_errors_total counter\n")
+	for _, method := range methods {
+		codes := s.methods[method].ErrorCodes
+		for _, code := range sortedKeys(codes) {
+			ew.printf("ethspam_request_errors_total{method=%q,code=%q} %d\n", method, code, codes[code])
+		}
+	}
+
+	events := sortedEvents(s.events)
+	ew.printf("# HELP ethspam_events_total Events other than queries, such as subscription notifications.\n")
+	ew.printf("# TYPE ethspam_events_total counter\n")
+	for _, name := range events {
+		ew.printf("ethspam_events_total{event=%q} %d\n", name, s.events[name].Count)
+	}
+	ew.printf("# HELP ethspam_event_errors_total Failed events per error code.\n")
+	ew.printf("# TYPE ethspam_event_errors_total counter\n")
+	for _, name := range events {
+		codes := s.events[name].ErrorCodes
+		for _, code := range sortedKeys(codes) {
+			ew.printf("ethspam_event_errors_total{event=%q,code=%q} %d\n", name, code, codes[code])
+		}
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// errWriter remembers the first write error so a long sequence of writes
+// only needs to be checked once.
+type errWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (ew *errWriter) printf(format string, args ...interface{}) {
+	if ew.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(ew.w, format, args...)
+	ew.n += int64(n)
+	ew.err = err
+}
@@ -0,0 +1,105 @@
+package ethspam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/INFURA/go-ethlibs/jsonrpc"
+	"github.com/INFURA/go-ethlibs/node"
+)
+
+// Event signatures of common token contracts
+const (
+	topicTransfer = "0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef" // Transfer(address,address,uint256)
+	topicDeposit  = "0xe1fffcc4923d04b559f4d29a8bfc6cda04eb5b0d3c460751c2402c5c5cc9109c" // Deposit(address,uint256)
+)
+
+// networkContracts are the built-in contract lists by chain ID, used until
+// active contracts are discovered.
+var networkContracts = map[uint64][]Contract{
+	1: popularContracts,
+	11155111: { // Sepolia
+		{"0xfff9976782d46cc05630d1f6ebab18b2324d6b14", []string{topicDeposit}},  // WETH
+		{"0x1c7d4b196cb0c7b01d743fbc6116a902379c7238", []string{topicTransfer}}, // USDC
+	},
+	17000: { // Holesky
+		{"0x94373a4919b3240d86ea41593d5eba789fef3848", []string{topicDeposit}},  // WETH
+		{"0x3f1c547b21f65e10480de3ad8e19faac46c95034", []string{topicTransfer}}, // stETH
+	},
+	137: { // Polygon
+		{"0x0d500b1d8e8ef31e21c99d1db9a6444d3adf1270", []string{topicTransfer}}, // WMATIC
+		{"0x2791bca1f2de4661ed88a30c99a7a9449aa84174", []string{topicTransfer}}, // USDC.e
+		{"0xc2132d05d31c914a87c6611c10748aeb04b58e8f", []string{topicTransfer}}, // USDT
+		{"0x7ceb23fd6bc0add59e62ac25578270cff1b9f619", []string{topicTransfer}}, // WETH
+	},
+	42161: { // Arbitrum One
+		{"0x82af49447d8a07e3bd95bd0d56f35241523fbab1", []string{topicTransfer}}, // WETH
+		{"0xaf88d065e77c8cc2239327c5edb3a432268e5831", []string{topicTransfer}}, // USDC
+		{"0xfd086bc7cd5c481dcc9c85ebe478a1c0b69fcbb9", []string{topicTransfer}}, // USDT
+		{"0x912ce59144191c1204e64559fe8253a0e49e6548", []string{topicTransfer}}, // ARB
+	},
+	8453: { // Base
+		{"0x4200000000000000000000000000000000000006", []string{topicTransfer}}, // WETH
+		{"0x833589fcd6edb6e08f4c7c32d4f71b54bda02913", []string{topicTransfer}}, // USDC
+	},
+	56: { // BNB Smart Chain
+		{"0xbb4cdb9cbd36b01bd1cbaebf2de08d9173bc095c", []string{topicTransfer}}, // WBNB
+		{"0xe9e7cea3dedca5984780bafc599bd69add087d56", []string{topicTransfer}}, // BUSD
+		{"0x55d398326f99059ff775485246999027b3197955", []string{topicTransfer}}, // USDT
+	},
+}
+
+// NetworkContracts returns the built-in contract list of the chain, or nil if
+// there is none.
+func NetworkContracts(chainID uint64) []Contract {
+	return networkContracts[chainID]
+}
+
+// LoadContracts reads contract lists from a JSON object keyed by chain ID,
+// such as {"1": [{"address": "0x...", "topics": ["0x..."]}]}.
+func LoadContracts(r io.Reader) (map[uint64][]Contract, error) {
+	var lists map[uint64][]Contract
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&lists); err != nil {
+		return nil, err
+	}
+	for chainID, contracts := range lists {
+		for _, c := range contracts {
+			if c.Addr == "" {
+				return nil, fmt.Errorf("contract without an address for chain %d", chainID)
+			}
+		}
+	}
+	return lists, nil
+}
+
+// ChainID asks the endpoint for its chain ID with eth_chainId.
+func ChainID(ctx context.Context, client node.Client) (uint64, error) {
+	return requestQuantity(ctx, client, "eth_chainId")
+}
+
+// requestQuantity calls a method that returns a hex quantity.
+func requestQuantity(ctx context.Context, client node.Client, method string, params ...interface{}) (uint64, error) {
+	resp, err := client.Request(ctx, &jsonrpc.Request{
+		JSONRPC: "2.0",
+		ID:      jsonrpc.ID{Num: 1},
+		Method:  method,
+		Params:  jsonrpc.MustParams(params...),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if resp.Error != nil {
+		return 0, fmt.Errorf("%s failed: %s", method, *resp.Error)
+	}
+	var quantity string
+	if err := json.Unmarshal(resp.Result, &quantity); err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimPrefix(quantity, "0x"), 16, 64)
+}
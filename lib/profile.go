@@ -0,0 +1,361 @@
+package ethspam
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Defaults for tunables left unset in a Profile
+const (
+	DefaultRefreshInterval = 15 * time.Second
+	DefaultTxPoolSize      = 50
+	DefaultBlockRange      = 5000 // eth_getLogs: ~a day of blocks
+	DefaultRecency         = 5    // ~a minute of blocks
+	DefaultRangeAlpha      = 0.5  // eth_getLogs: half the ranges within 4 blocks, 1.4% beyond 5000
+	DefaultPollInterval    = 4 * time.Second
+	DefaultFilterPolls     = 30 // ~2 minutes of polling
+)
+
+// DefaultLogFilters are the eth_getLogs filter shapes used when a profile
+// doesn't set any.
+var DefaultLogFilters = LogFilters{
+	BlockHash:    0.05,
+	Tag:          0.1,
+	AddressArray: 0.1,
+	NoAddress:    0.05,
+	TopicOr:      0.1,
+	Wildcard:     0.1,
+	NoTopics:     0.1,
+}
+
+// DefaultTraceTypes are the trace types of trace_call and trace_replay*
+// queries when a profile doesn't set any.
+var DefaultTraceTypes = []TraceTypes{
+	{Weight: 1, Types: []string{"trace"}},
+}
+
+// DefaultTracers are the tracers of debug_trace* queries when a profile
+// doesn't set any.
+var DefaultTracers = []Tracer{
+	{Weight: 1, Config: json.RawMessage(`{"tracer":"callTracer"}`)},
+}
+
+// DefaultFilterMix is the filter lifecycle used when a profile doesn't set
+// one.
+var DefaultFilterMix = FilterMix{
+	Block:              0.3,
+	PendingTransaction: 0.1,
+	FilterLogs:         0.1,
+	Leak:               0.2,
+}
+
+// Profile is a traffic profile: the weight of each method along with the
+// tunables of its generator and of the state it samples from. Profiles are
+// meant to be checked into version control as JSON files.
+type Profile struct {
+	// RefreshInterval is the longest time between state refreshes when
+	// polling the endpoint for new heads
+	RefreshInterval Duration `json:"refreshInterval,omitempty"`
+	// TxPoolSize is the number of transactions kept in the state
+	TxPoolSize int `json:"txPoolSize,omitempty"`
+	// OrphanedShare is the fraction of block and transaction hashes drawn
+	// from blocks dropped by chain reorgs, 0 to never query them
+	OrphanedShare float64 `json:"orphanedShare,omitempty"`
+	// ReceiptSamples is the number of receipts fetched per block to discover
+	// active contracts, DefaultReceiptSamples if zero and none if negative
+	ReceiptSamples int `json:"receiptSamples,omitempty"`
+
+	Methods map[string]MethodProfile `json:"methods"`
+	// Scenarios are user journeys weighted alongside the methods
+	Scenarios map[string]Scenario `json:"scenarios,omitempty"`
+}
+
+// MethodProfile configures a single generator. Tunables only apply to the
+// methods that use them and are replaced by defaults when zero.
+type MethodProfile struct {
+	Weight int64 `json:"weight"`
+
+	// BlockRange is the maximum number of blocks an eth_getLogs filter spans
+	BlockRange uint64 `json:"blockRange,omitempty"`
+	// Recency is the maximum distance from the current block for queries
+	// anchored on recent blocks
+	Recency uint64 `json:"recency,omitempty"`
+	// RangeAlpha is the shape of the Pareto distribution of eth_getLogs block
+	// ranges, lower values give more long ranges
+	RangeAlpha float64 `json:"rangeAlpha,omitempty"`
+	// Filters are the shares of eth_getLogs filter shapes, DefaultLogFilters
+	// if unset
+	Filters *LogFilters `json:"filters,omitempty"`
+
+	// PollInterval is the time between polls of a filter by the filters
+	// sessions
+	PollInterval Duration `json:"pollInterval,omitempty"`
+	// Polls is the mean number of polls before a filter is dropped
+	Polls int `json:"polls,omitempty"`
+	// FilterMix is the shape of the filters sessions, DefaultFilterMix if
+	// unset
+	FilterMix *FilterMix `json:"filterMix,omitempty"`
+
+	// TraceTypes are the combinations of trace types that trace_call and
+	// trace_replay* queries pick from in proportion to their weights,
+	// DefaultTraceTypes if unset
+	TraceTypes []TraceTypes `json:"traceTypes,omitempty"`
+	// Tracers are the trace configs that debug_trace* queries pick from in
+	// proportion to their weights, DefaultTracers if unset
+	Tracers []Tracer `json:"tracers,omitempty"`
+}
+
+// Tracer is a weighted trace config of debug_trace* queries. The config is
+// sent as is, so it can use any tracer and option of the endpoint, such as
+// {"tracer": "prestateTracer", "tracerConfig": {"diffMode": true}},
+// {"tracer": "4byteTracer"}, {"enableMemory": true, "disableStorage": true}
+// for the struct logger, the source of a JS tracer, or a "timeout".
+type Tracer struct {
+	Weight int64           `json:"weight"`
+	Config json.RawMessage `json:"config"`
+}
+
+// TraceTypes is a weighted combination of the trace, vmTrace and stateDiff
+// trace types of trace_call and trace_replay* queries, such as
+// {"weight": 1, "types": ["trace", "stateDiff"]}.
+type TraceTypes struct {
+	Weight int64    `json:"weight"`
+	Types  []string `json:"types"`
+}
+
+// LogFilters are the probabilities of eth_getLogs filter variants, each
+// drawn independently. Filters that use none of them query a block range
+// near the tip for a single contract and its most common event.
+type LogFilters struct {
+	// BlockHash filters a single block by hash instead of a range
+	BlockHash float64 `json:"blockHash"`
+	// Tag uses a latest, safe or finalized tag instead of block numbers
+	Tag float64 `json:"tag"`
+	// AddressArray filters several contracts at once
+	AddressArray float64 `json:"addressArray"`
+	// NoAddress filters by topics alone
+	NoAddress float64 `json:"noAddress"`
+	// TopicOr matches any of several event signatures
+	TopicOr float64 `json:"topicOr"`
+	// Wildcard matches any event with an account as the first indexed
+	// argument, such as transfers from it
+	Wildcard float64 `json:"wildcard"`
+	// NoTopics matches every event of the contracts
+	NoTopics float64 `json:"noTopics"`
+}
+
+func (f LogFilters) validate() error {
+	for _, share := range []float64{f.BlockHash, f.Tag, f.AddressArray, f.NoAddress, f.TopicOr, f.Wildcard, f.NoTopics} {
+		if share < 0 || share > 1 {
+			return errors.New("filter shares must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// FilterMix are the shares of filter kinds and calls in filters sessions.
+// Filters that are neither block nor pending transaction filters are log
+// filters installed with eth_newFilter.
+type FilterMix struct {
+	// Block is the share of eth_newBlockFilter filters
+	Block float64 `json:"block"`
+	// PendingTransaction is the share of eth_newPendingTransactionFilter
+	// filters
+	PendingTransaction float64 `json:"pendingTransaction"`
+	// FilterLogs is the share of log filter polls made with
+	// eth_getFilterLogs instead of eth_getFilterChanges
+	FilterLogs float64 `json:"filterLogs"`
+	// Leak is the share of filters abandoned without eth_uninstallFilter
+	Leak float64 `json:"leak"`
+}
+
+func (m FilterMix) validate() error {
+	for _, share := range []float64{m.Block, m.PendingTransaction, m.FilterLogs, m.Leak} {
+		if share < 0 || share > 1 {
+			return errors.New("filter mix shares must be between 0 and 1")
+		}
+	}
+	if m.Block+m.PendingTransaction > 1 {
+		return errors.New("block and pendingTransaction shares must add up to at most 1")
+	}
+	return nil
+}
+
+func (p MethodProfile) withDefaults() MethodProfile {
+	if p.BlockRange == 0 {
+		p.BlockRange = DefaultBlockRange
+	}
+	if p.Recency == 0 {
+		p.Recency = DefaultRecency
+	}
+	if p.RangeAlpha == 0 {
+		p.RangeAlpha = DefaultRangeAlpha
+	}
+	if p.Filters == nil {
+		filters := DefaultLogFilters
+		p.Filters = &filters
+	}
+	if p.PollInterval == 0 {
+		p.PollInterval = Duration(DefaultPollInterval)
+	}
+	if p.Polls == 0 {
+		p.Polls = DefaultFilterPolls
+	}
+	if p.FilterMix == nil {
+		mix := DefaultFilterMix
+		p.FilterMix = &mix
+	}
+	if len(p.TraceTypes) == 0 {
+		p.TraceTypes = DefaultTraceTypes
+	}
+	if len(p.Tracers) == 0 {
+		p.Tracers = DefaultTracers
+	}
+	return p
+}
+
+// ProfileFromWeights returns a Profile with the given method weights and
+// default tunables.
+func ProfileFromWeights(methods map[string]int64) Profile {
+	profile := Profile{
+		RefreshInterval: Duration(DefaultRefreshInterval),
+		TxPoolSize:      DefaultTxPoolSize,
+		Methods:         make(map[string]MethodProfile, len(methods)),
+	}
+	for method, weight := range methods {
+		profile.Methods[method] = MethodProfile{Weight: weight}
+	}
+	return profile
+}
+
+// LoadProfile reads a JSON Profile, filling in defaults for unset tunables.
+func LoadProfile(r io.Reader) (Profile, error) {
+	var profile Profile
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&profile); err != nil {
+		return Profile{}, err
+	}
+	if len(profile.Methods) == 0 && len(profile.Scenarios) == 0 {
+		return Profile{}, fmt.Errorf("profile has no methods or scenarios")
+	}
+	if profile.OrphanedShare < 0 || profile.OrphanedShare > 1 {
+		return Profile{}, fmt.Errorf("orphanedShare must be between 0 and 1")
+	}
+	for method, p := range profile.Methods {
+		if p.RangeAlpha < 0 {
+			return Profile{}, fmt.Errorf("%s: rangeAlpha must not be negative", method)
+		}
+		if p.Filters != nil {
+			if err := p.Filters.validate(); err != nil {
+				return Profile{}, fmt.Errorf("%s: %s", method, err)
+			}
+		}
+		if p.PollInterval < 0 || p.Polls < 0 {
+			return Profile{}, fmt.Errorf("%s: pollInterval and polls must not be negative", method)
+		}
+		if p.FilterMix != nil {
+			if err := p.FilterMix.validate(); err != nil {
+				return Profile{}, fmt.Errorf("%s: %s", method, err)
+			}
+		}
+		if len(p.TraceTypes) > 0 {
+			if err := checkTraceTypes(p.TraceTypes); err != nil {
+				return Profile{}, fmt.Errorf("%s: %s", method, err)
+			}
+		}
+		if len(p.Tracers) > 0 {
+			tracers, err := compactTracers(p.Tracers)
+			if err != nil {
+				return Profile{}, fmt.Errorf("%s: %s", method, err)
+			}
+			p.Tracers = tracers
+			profile.Methods[method] = p
+		}
+	}
+	for name, sc := range profile.Scenarios {
+		if err := sc.validate(); err != nil {
+			return Profile{}, fmt.Errorf("scenario %s: %s", name, err)
+		}
+	}
+	if profile.RefreshInterval == 0 {
+		profile.RefreshInterval = Duration(DefaultRefreshInterval)
+	}
+	if profile.TxPoolSize == 0 {
+		profile.TxPoolSize = DefaultTxPoolSize
+	}
+	return profile, nil
+}
+
+// checkTraceTypes checks the weights and trace types of the combinations.
+func checkTraceTypes(sets []TraceTypes) error {
+	var total int64
+	for _, set := range sets {
+		if set.Weight < 0 {
+			return errors.New("trace type weights must not be negative")
+		}
+		if len(set.Types) == 0 {
+			return errors.New("empty trace type combination")
+		}
+		for _, t := range set.Types {
+			if !traceTypes[t] {
+				return errors.New("unknown trace type " + t)
+			}
+		}
+		total += set.Weight
+	}
+	if total == 0 {
+		return errors.New("trace types have no weight")
+	}
+	return nil
+}
+
+// compactTracers checks the weights and configs of the tracers, returning
+// them with configs on a single line.
+func compactTracers(tracers []Tracer) ([]Tracer, error) {
+	var total int64
+	compacted := make([]Tracer, len(tracers))
+	for i, t := range tracers {
+		if t.Weight < 0 {
+			return nil, errors.New("tracer weights must not be negative")
+		}
+		var config map[string]json.RawMessage
+		if json.Unmarshal(t.Config, &config) != nil || config == nil {
+			return nil, errors.New("tracer configs must be JSON objects")
+		}
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, t.Config); err != nil {
+			return nil, err
+		}
+		compacted[i] = Tracer{Weight: t.Weight, Config: buf.Bytes()}
+		total += t.Weight
+	}
+	if total == 0 {
+		return nil, errors.New("tracers have no weight")
+	}
+	return compacted, nil
+}
+
+// Duration is a time.Duration that is written as a string like "15s" in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
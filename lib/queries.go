@@ -1,36 +1,71 @@
 package ethspam
 
 import (
+	"encoding/json"
 	"errors"
-	"fmt"
 	"sort"
-	"strings"
+	"strconv"
 )
 
 type QueryContent struct {
 	Id     int64
 	Method string
 	Params string
+
+	// Name is the RandomQuery.Method that produced the content, which can be
+	// a variant such as eth_getBlockByNumber#full. Sessions name their
+	// queries by method.
+	Name string
+
+	// Responder, when set, is answered the response to the query so that
+	// follow-up queries can depend on it.
+	Responder Responder
+}
+
+// Responder is answered the responses to the queries of a session, such as a
+// filter to poll with the ID the endpoint returned.
+type Responder interface {
+	Respond(q QueryContent, result json.RawMessage, err error)
+}
+
+// Answer passes the result of the query, or the error it failed with, to its
+// Responder if any. Queries that are printed rather than sent are answered
+// with neither.
+func (q *QueryContent) Answer(result json.RawMessage, err error) {
+	if q.Responder != nil {
+		q.Responder.Respond(*q, result, err)
+	}
 }
 
 func (q *QueryContent) GetBody() string {
-	return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"%s","params":%s}`+"\n", q.Id, q.Method, q.Params)
+	return string(q.AppendBody(nil))
+}
+
+// behind returns the block n blocks before the given one, stopping at genesis.
+func behind(block, n uint64) uint64 {
+	if n > block {
+		return 0
+	}
+	return block - n
+}
+
+// blockTag returns the tag for queries of the current chain state, or the
+// anchor of states that anchor every query.
+func blockTag(s State, tag string) string {
+	if a, ok := s.(anchoredState); ok {
+		return a.anchorTag()
+	}
+	return tag
 }
 
 func genEthCall(s State) QueryContent {
 	// We eth_call the block before the call actually happened to avoid collision reverts
 	to, from, input, block := s.RandomCall()
-	res := QueryContent{
+	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_call",
+		Params: callParams(to, from, input, block-1),
 	}
-	if to != "" {
-		res.Params = fmt.Sprintf(`[{"to":%q,"from":%q,"data":%q},"0x%x"]`, to, from, input, block-1)
-	} else {
-		res.Params = fmt.Sprintf(`[{"from":%q,"data":%q},"0x%x"]`, from, input, block-1)
-	}
-
-	return res
 }
 
 func genEthGetTransactionReceipt(s State) QueryContent {
@@ -38,7 +73,7 @@ func genEthGetTransactionReceipt(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getTransactionReceipt",
-		Params: fmt.Sprintf(`["%s"]`, txID),
+		Params: stringParams(txID),
 	}
 }
 
@@ -47,27 +82,31 @@ func genEthGetBalance(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getBalance",
-		Params: fmt.Sprintf(`["%s","latest"]`, addr),
+		Params: `["` + addr + `","` + blockTag(s, "latest") + `"]`,
 	}
 }
 
-func genEthGetBlockByNumber(s State) QueryContent {
-	r := s.RandInt64()
-	blockNum := s.CurrentBlock() - uint64(r%5) // Within the last ~minute
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "eth_getBlockByNumber",
-		Params: fmt.Sprintf(`["0x%x",false]`, blockNum),
+func genEthGetBlockByNumber(p MethodProfile) Generator {
+	return func(s State) QueryContent {
+		r := s.RandInt64()
+		blockNum := behind(s.CurrentBlock(), uint64(r)%p.Recency) // Within the last ~minute
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "eth_getBlockByNumber",
+			Params: blockParams(blockNum, false),
+		}
 	}
 }
 
-func genEthGetBlockByNumberFull(s State) QueryContent {
-	r := s.RandInt64()
-	blockNum := s.CurrentBlock() - uint64(r%5) // Within the last ~minute
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "eth_getBlockByNumber",
-		Params: fmt.Sprintf(`["0x%x",true]`, blockNum),
+func genEthGetBlockByNumberFull(p MethodProfile) Generator {
+	return func(s State) QueryContent {
+		r := s.RandInt64()
+		blockNum := behind(s.CurrentBlock(), uint64(r)%p.Recency) // Within the last ~minute
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "eth_getBlockByNumber",
+			Params: blockParams(blockNum, true),
+		}
 	}
 }
 
@@ -76,7 +115,7 @@ func genEthGetTransactionCount(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getTransactionCount",
-		Params: fmt.Sprintf(`["%s","pending"]`, addr),
+		Params: `["` + addr + `","` + blockTag(s, "pending") + `"]`,
 	}
 }
 
@@ -93,21 +132,21 @@ func genEthGetTransactionByHash(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getTransactionByHash",
-		Params: fmt.Sprintf(`["%s"]`, txID),
+		Params: stringParams(txID),
 	}
 }
 
-func genEthGetLogs(s State) QueryContent {
-	r := s.RandInt64()
-	// TODO: Favour latest/recent block on a curve
-	fromBlock := s.CurrentBlock() - uint64(r%5000) // Pick a block within the last ~day
-	toBlock := s.CurrentBlock() - uint64(r%5)      // Within the last ~minute
-	address, topics := s.RandomContract()
-	topicsJoined := strings.Join(topics, `","`)
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "eth_getLogs",
-		Params: fmt.Sprintf(`[{"fromBlock":"0x%x","toBlock":"0x%x","address":"%s","topics":["%s"]}]`, fromBlock, toBlock, address, topicsJoined),
+func genEthGetLogs(p MethodProfile) Generator {
+	return func(s State) QueryContent {
+		var buf [512]byte
+		b := append(buf[:0], '[')
+		b = appendLogFilter(b, s, p)
+		b = append(b, ']')
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "eth_getLogs",
+			Params: string(b),
+		}
 	}
 }
 
@@ -116,23 +155,17 @@ func genEthGetCode(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getCode",
-		Params: fmt.Sprintf(`["%s","latest"]`, addr),
+		Params: `["` + addr + `","` + blockTag(s, "latest") + `"]`,
 	}
 }
 
 func genEthEstimateGas(s State) QueryContent {
 	to, from, input, block := s.RandomCall()
-	res := QueryContent{
+	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_estimateGas",
+		Params: callParams(to, from, input, block-1),
 	}
-	if to != "" {
-		res.Params = fmt.Sprintf(`[{"to":%q,"from":%q,"data":%q},"0x%x"]`, to, from, input, block-1)
-	} else {
-		res.Params = fmt.Sprintf(`[{"from":%q,"data":%q},"0x%x"]`, from, input, block-1)
-	}
-
-	return res
 }
 
 func getEthGetBlockByHash(s State) QueryContent {
@@ -140,7 +173,7 @@ func getEthGetBlockByHash(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getBlockByHash",
-		Params: fmt.Sprintf(`["%s",false]`, block),
+		Params: `["` + block + `",false]`,
 	}
 }
 
@@ -149,17 +182,23 @@ func getEthGetBlockByHashFull(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getBlockByHash",
-		Params: fmt.Sprintf(`["%s",true]`, block),
+		Params: `["` + block + `",true]`,
 	}
 }
 
 func getEthGetTransactionByBlockNumberAndIndex(s State) QueryContent {
 	r := s.RandInt64()
-	blockNum := s.CurrentBlock() - uint64(r%100) - 200
+	blockNum := behind(s.CurrentBlock(), uint64(r%100)+200)
+	var buf [64]byte
+	b := append(buf[:0], '[')
+	b = appendQuantity(b, blockNum)
+	b = append(b, ',')
+	b = appendQuantity(b, uint64(r%5))
+	b = append(b, ']')
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getTransactionByBlockNumberAndIndex",
-		Params: fmt.Sprintf(`["0x%x","0x%x"]`, blockNum, r%5),
+		Params: string(b),
 	}
 }
 
@@ -208,7 +247,7 @@ func getEthGetStorageAt(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getStorageAt",
-		Params: fmt.Sprintf(`["%s","0x0","latest"]`, addr),
+		Params: `["` + addr + `","0x0","` + blockTag(s, "latest") + `"]`,
 	}
 }
 
@@ -238,10 +277,14 @@ func getEthProtocolVersion(s State) QueryContent {
 }
 
 func getEthFeeHistory(s State) QueryContent {
+	var buf [32]byte
+	b := append(buf[:0], '[')
+	b = strconv.AppendInt(b, s.RandInt64()%10, 10)
+	b = append(b, `, "latest", []]`...)
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_feeHistory",
-		Params: fmt.Sprintf(`[%d, "latest", []]`, s.RandInt64()%10),
+		Params: string(b),
 	}
 }
 
@@ -256,10 +299,16 @@ func getEthMaxPriorityFeePerGas(s State) QueryContent {
 func getEthGetTransactionByBlockHashAndIndex(s State) QueryContent {
 	r := s.RandInt64()
 	hash := s.RandomBlock()
+	var buf [128]byte
+	b := append(buf[:0], '[')
+	b = appendString(b, hash)
+	b = append(b, ',')
+	b = appendQuantity(b, uint64(r%5))
+	b = append(b, ']')
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getTransactionByBlockHashAndIndex",
-		Params: fmt.Sprintf(`["%s","0x%x"]`, hash, r%5),
+		Params: string(b),
 	}
 }
 
@@ -268,16 +317,20 @@ func getEthGetBlockTransactionCountByHash(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getBlockTransactionCountByHash",
-		Params: fmt.Sprintf(`["%s"]`, hash),
+		Params: stringParams(hash),
 	}
 }
 
 func getEthGetBlockTransactionCountByNumber(s State) QueryContent {
-	block := s.CurrentBlock() - uint64(s.RandInt64()%100)
+	block := behind(s.CurrentBlock(), uint64(s.RandInt64()%100))
+	var buf [32]byte
+	b := append(buf[:0], '[')
+	b = appendQuantity(b, block)
+	b = append(b, ']')
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getBlockTransactionCountByNumber",
-		Params: fmt.Sprintf(`["0x%x"]`, block),
+		Params: string(b),
 	}
 }
 
@@ -285,68 +338,7 @@ func getEthGetBlockReceipts(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getBlockReceipts",
-		Params: `["latest"]`,
-	}
-}
-
-func getTraceBlock(s State) QueryContent {
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "trace_block",
-		Params: `["latest"]`,
-	}
-}
-
-func getTraceTransaction(s State) QueryContent {
-	hash := s.RandomTransaction()
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "trace_transaction",
-		Params: fmt.Sprintf(`["%s"]`, hash),
-	}
-}
-
-func getTraceReplayTransaction(s State) QueryContent {
-	hash := s.RandomTransaction()
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "trace_replayTransaction",
-		Params: fmt.Sprintf(`["%s", ["trace"]]`, hash),
-	}
-}
-
-func getTraceReplayBlockTransactions(s State) QueryContent {
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "trace_replayBlockTransactions",
-		Params: `["latest", ["trace"]]`,
-	}
-}
-
-func getDebugTraceTransaction(s State) QueryContent {
-	hash := s.RandomTransaction()
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "debug_traceTransaction",
-		Params: fmt.Sprintf(`["%s", {"tracer": "callTracer"}]`, hash),
-	}
-}
-
-func getDebugTraceBlockByNumber(s State) QueryContent {
-	block := s.CurrentBlock() - uint64(s.RandInt64()%1000)
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "debug_traceBlockByNumber",
-		Params: fmt.Sprintf(`["0x%x", {"tracer": "callTracer"}]`, block),
-	}
-}
-
-func getDebugTraceBlockByHash(s State) QueryContent {
-	hash := s.RandomBlock()
-	return QueryContent{
-		Id:     s.ID(),
-		Method: "debug_traceBlockByHash",
-		Params: fmt.Sprintf(`["%s", {"tracer": "callTracer"}]`, hash),
+		Params: stringParams(blockTag(s, "latest")),
 	}
 }
 
@@ -355,21 +347,103 @@ func getEthCreateAccessList(s State) QueryContent {
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_createAccessList",
-		Params: fmt.Sprintf(`[{"from": "%s", "to": "%s", "data": "%s"}, "0x%x"]`, from, to, input, block-1),
+		Params: callParams(to, from, input, block-1),
 	}
 }
 
 func getEthGetProof(s State) QueryContent {
 	to, _, _, block := s.RandomCall()
+	var buf [128]byte
+	b := append(buf[:0], '[')
+	b = appendString(b, to)
+	b = append(b, `, ["0x0"], `...)
+	b = appendQuantity(b, block-1)
+	b = append(b, ']')
 	return QueryContent{
 		Id:     s.ID(),
 		Method: "eth_getProof",
-		Params: fmt.Sprintf(`["%s", ["0x0"], "0x%x"]`, to, block-1),
-	}
+		Params: string(b),
+	}
+}
+
+var rpcMethod = map[string]Generator{
+	"eth_call":                                genEthCall,
+	"eth_getTransactionReceipt":               genEthGetTransactionReceipt,
+	"eth_getBalance":                          genEthGetBalance,
+	"eth_getTransactionCount":                 genEthGetTransactionCount,
+	"eth_blockNumber":                         genEthBlockNumber,
+	"eth_getTransactionByHash":                genEthGetTransactionByHash,
+	"eth_getCode":                             genEthGetCode,
+	"eth_estimateGas":                         genEthEstimateGas,
+	"eth_getBlockByHash":                      getEthGetBlockByHash,
+	"eth_getBlockByHash#full":                 getEthGetBlockByHashFull,
+	"eth_getTransactionByBlockNumberAndIndex": getEthGetTransactionByBlockNumberAndIndex,
+	"net_version":                             getNetVersion,
+	"eth_gasPrice":                            getEthGasPrice,
+	"net_listening":                           getNetListening,
+	"net_peerCount":                           getNetPeerCount,
+	"eth_syncing":                             getEthSyncing,
+	"eth_getStorageAt":                        getEthGetStorageAt,
+	"eth_accounts":                            getEthAccounts,
+	"eth_chainId":                             getEthChainId,
+	"eth_protocolVersion":                     getEthProtocolVersion,
+	"eth_feeHistory":                          getEthFeeHistory,
+	"eth_maxPriorityFeePerGas":                getEthMaxPriorityFeePerGas,
+	"eth_getTransactionByBlockHashAndIndex":   getEthGetTransactionByBlockHashAndIndex,
+	"eth_getBlockTransactionCountByHash":      getEthGetBlockTransactionCountByHash,
+	"eth_getBlockTransactionCountByNumber":    getEthGetBlockTransactionCountByNumber,
+	"eth_getBlockReceipts":                    getEthGetBlockReceipts,
+	"trace_block":                             getTraceBlock,
+	"trace_transaction":                       getTraceTransaction,
+	"trace_get":                               getTraceGet,
+	"eth_createAccessList":                    getEthCreateAccessList,
+	"eth_getProof":                            getEthGetProof,
+}
+
+// Generators with tunables from the method profile
+var tunedMethod = map[string]func(MethodProfile) Generator{
+	"eth_getBlockByNumber":          genEthGetBlockByNumber,
+	"eth_getBlockByNumber#full":     genEthGetBlockByNumberFull,
+	"eth_getLogs":                   genEthGetLogs,
+	"trace_filter":                  genTraceFilter,
+	"trace_call":                    genTraceCall,
+	"trace_callMany":                genTraceCallMany,
+	"trace_replayTransaction":       genTraceReplayTransaction,
+	"trace_replayBlockTransactions": genTraceReplayBlockTransactions,
+	"debug_traceTransaction":        genDebugTraceTransaction,
+	"debug_traceBlockByNumber":      genDebugTraceBlockByNumber,
+	"debug_traceBlockByHash":        genDebugTraceBlockByHash,
+	"debug_traceCall":               genDebugTraceCall,
+	"filters": func(p MethodProfile) Generator {
+		return NewFilterSessions(p).Generate
+	},
+}
+
+// IsSupported reports whether a generator exists for the method, including
+// variants such as eth_getBlockByNumber#full and methods generated by sources
+// configured at startup.
+func IsSupported(method string) bool {
+	if _, ok := rpcMethod[method]; ok {
+		return true
+	}
+	if _, ok := tunedMethod[method]; ok {
+		return true
+	}
+	return runtimeMethods[method]
+}
+
+// MakeQueriesGenerator returns a generator for the given method weights with
+// default tunables.
+func MakeQueriesGenerator(methods map[string]int64) (gen QueriesGenerator, err error) {
+	return MakeProfileQueriesGenerator(ProfileFromWeights(methods), nil)
 }
 
-func MakeQueriesGenerator(methods map[string]int64) (gen QueriesGenerator, err error) {
+// MakeProfileQueriesGenerator returns a generator for the methods and
+// scenarios of the profile. Methods such as eth_sendRawTransaction are generated by the
+// sources, such as a Wallet, by method.
+func MakeProfileQueriesGenerator(profile Profile, sources map[string]Generator) (gen QueriesGenerator, err error) {
 	// Top queries by weight, pulled from a 5000 Infura query sample on Dec 2019.
+	// ProfileFromLog derives fresher weights from your own traffic.
 	//     3 "eth_accounts"
 	//     4 "eth_getStorageAt"
 	//     4 "eth_syncing"
@@ -391,58 +465,62 @@ func MakeQueriesGenerator(methods map[string]int64) (gen QueriesGenerator, err e
 	//   607 "eth_getTransactionReceipt"
 	//  1928 "eth_call"
 
-	rpcMethod := map[string]func(State) QueryContent{
-		"eth_call":                                genEthCall,
-		"eth_getTransactionReceipt":               genEthGetTransactionReceipt,
-		"eth_getBalance":                          genEthGetBalance,
-		"eth_getBlockByNumber":                    genEthGetBlockByNumber,
-		"eth_getBlockByNumber#full":               genEthGetBlockByNumberFull,
-		"eth_getTransactionCount":                 genEthGetTransactionCount,
-		"eth_blockNumber":                         genEthBlockNumber,
-		"eth_getTransactionByHash":                genEthGetTransactionByHash,
-		"eth_getLogs":                             genEthGetLogs,
-		"eth_getCode":                             genEthGetCode,
-		"eth_estimateGas":                         genEthEstimateGas,
-		"eth_getBlockByHash":                      getEthGetBlockByHash,
-		"eth_getBlockByHash#full":                 getEthGetBlockByHashFull,
-		"eth_getTransactionByBlockNumberAndIndex": getEthGetTransactionByBlockNumberAndIndex,
-		"net_version":                             getNetVersion,
-		"eth_gasPrice":                            getEthGasPrice,
-		"net_listening":                           getNetListening,
-		"net_peerCount":                           getNetPeerCount,
-		"eth_syncing":                             getEthSyncing,
-		"eth_getStorageAt":                        getEthGetStorageAt,
-		"eth_accounts":                            getEthAccounts,
-		"eth_chainId":                             getEthChainId,
-		"eth_protocolVersion":                     getEthProtocolVersion,
-		"eth_feeHistory":                          getEthFeeHistory,
-		"eth_maxPriorityFeePerGas":                getEthMaxPriorityFeePerGas,
-		"eth_getTransactionByBlockHashAndIndex":   getEthGetTransactionByBlockHashAndIndex,
-		"eth_getBlockTransactionCountByHash":      getEthGetBlockTransactionCountByHash,
-		"eth_getBlockTransactionCountByNumber":    getEthGetBlockTransactionCountByNumber,
-		"eth_getBlockReceipts":                    getEthGetBlockReceipts,
-		"trace_block":                             getTraceBlock,
-		"trace_transaction":                       getTraceTransaction,
-		"trace_traceReplayTransaction":            getTraceReplayTransaction,
-		"trace_replayBlockTransactions":           getTraceReplayBlockTransactions,
-		"debug_traceTransaction":                  getDebugTraceTransaction,
-		"debug_traceBlockByNumber":                getDebugTraceBlockByNumber,
-		"debug_traceBlockByHash":                  getDebugTraceBlockByHash,
-		"eth_createAccessList":                    getEthCreateAccessList,
-		"eth_getProof":                            getEthGetProof,
-	}
-
-	for method, weight := range methods {
-		if weight == 0 {
+	// Add in a stable order so that seeded runs are reproducible
+	methods := make([]string, 0, len(profile.Methods))
+	for method := range profile.Methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		p := profile.Methods[method]
+		if p.Weight < 0 {
+			return QueriesGenerator{}, errors.New(method + " has a negative weight")
+		}
+		if p.Weight == 0 {
 			continue
 		}
-		if _, ok := rpcMethod[method]; !ok {
+		generate, ok := rpcMethod[method]
+		if tuned, isTuned := tunedMethod[method]; isTuned {
+			generate, ok = tuned(p.withDefaults()), true
+		}
+		if runtimeMethods[method] {
+			if generate, ok = sources[method]; !ok {
+				return QueriesGenerator{}, errors.New(method + " needs a source, such as signing keys")
+			}
+		}
+		if !ok {
 			return QueriesGenerator{}, errors.New(method + " is not supported")
 		}
 		gen.Add(RandomQuery{
 			Method:   method,
-			Weight:   weight,
-			Generate: rpcMethod[method],
+			Weight:   p.Weight,
+			Generate: generate,
+		})
+	}
+
+	names := make([]string, 0, len(profile.Scenarios))
+	for name := range profile.Scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		sc := profile.Scenarios[name]
+		if sc.Weight < 0 {
+			return QueriesGenerator{}, errors.New("scenario " + name + " has a negative weight")
+		}
+		if sc.Weight == 0 {
+			continue
+		}
+		journey, err := NewJourney(name, sc)
+		if err != nil {
+			return QueriesGenerator{}, err
+		}
+		gen.Add(RandomQuery{
+			Method:   name,
+			Weight:   sc.Weight,
+			Generate: journey.Generate,
 		})
 	}
 
@@ -457,42 +535,84 @@ type RandomQuery struct {
 	Generate Generator
 }
 
+// QueriesGenerator picks generators in proportion to their weights with
+// Vose's alias method, in constant time per query. Query is goroutine-safe
+// once all queries are added, given each goroutine its own State fork.
 type QueriesGenerator struct {
-	queries     []RandomQuery // sorted by weight asc
+	queries     []RandomQuery
 	totalWeight int64
+
+	// Alias table: column i keeps query i when a draw below totalWeight
+	// falls under prob[i], and takes query alias[i] otherwise
+	prob  []int64
+	alias []int
 }
 
 // Add inserts a random query QueriesGenerator with a weighted probability. Not
 // goroutine-safe, should be run once during initialization.
 func (g *QueriesGenerator) Add(query RandomQuery) {
-	if g.queries == nil {
-		g.queries = make([]RandomQuery, 1)
-	} else {
-		g.queries = append(g.queries, RandomQuery{})
-	}
-	// Maintain weight sort
-	idx := sort.Search(len(g.queries), func(i int) bool { return g.queries[i].Weight < query.Weight })
-	copy(g.queries[idx+1:], g.queries[idx:])
-	g.queries[idx] = query
+	g.queries = append(g.queries, query)
 	g.totalWeight += query.Weight
+	g.buildAlias()
+}
+
+// buildAlias rebuilds the alias table for the current weights. Weights are
+// scaled by the number of queries so that the table is exact in integers.
+func (g *QueriesGenerator) buildAlias() {
+	n := int64(len(g.queries))
+	g.prob = make([]int64, n)
+	g.alias = make([]int, n)
+
+	scaled := make([]int64, n)
+	var small, large []int
+	for i, q := range g.queries {
+		scaled[i] = q.Weight * n
+		if scaled[i] < g.totalWeight {
+			small = append(small, i)
+		} else {
+			large = append(large, i)
+		}
+	}
+	for len(small) > 0 && len(large) > 0 {
+		l, h := small[len(small)-1], large[len(large)-1]
+		small, large = small[:len(small)-1], large[:len(large)-1]
+
+		g.prob[l] = scaled[l]
+		g.alias[l] = h
+		// The heavy query fills the rest of the light query's column
+		scaled[h] -= g.totalWeight - scaled[l]
+		if scaled[h] < g.totalWeight {
+			small = append(small, h)
+		} else {
+			large = append(large, h)
+		}
+	}
+	// Whatever is left fills its own column
+	for _, i := range append(small, large...) {
+		g.prob[i] = g.totalWeight
+		g.alias[i] = i
+	}
 }
 
 // Query selects a QueriesGenerator based on proportonal weighted probability and
 // writes the query from the QueriesGenerator.
 func (g *QueriesGenerator) Query(s State) (QueryContent, error) {
-	if len(g.queries) == 0 {
+	if len(g.queries) == 0 || g.totalWeight <= 0 {
 		return QueryContent{}, errors.New("no query generators available")
 	}
 
-	weight := s.RandInt64() % g.totalWeight
-
-	var current int64
-	for _, q := range g.queries {
-		current += q.Weight
-		if current >= weight {
-			return q.Generate(s), nil
-		}
+	i := int(s.RandInt64() % int64(len(g.queries)))
+	if s.RandInt64()%g.totalWeight >= g.prob[i] {
+		i = g.alias[i]
 	}
 
-	panic("off by one bug in weighted query selection")
+	q := g.queries[i]
+	if a, ok := s.(anchoredState); ok {
+		a.drawAnchor()
+	}
+	content := q.Generate(s)
+	if content.Name == "" {
+		content.Name = q.Method
+	}
+	return content, nil
 }
@@ -0,0 +1,104 @@
+package ethspam
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+func TestQueryFrequencies(t *testing.T) {
+	const draws = 1000000
+	// Several standard deviations of the frequency of a method at 1e6 draws
+	const tolerance = 0.003
+
+	tests := []struct {
+		name    string
+		weights map[string]int64
+	}{
+		{
+			name:    "skewed",
+			weights: map[string]int64{"eth_call": 2000, "eth_getBalance": 550, "eth_blockNumber": 350, "net_version": 25, "eth_accounts": 3},
+		},
+		{
+			name:    "single",
+			weights: map[string]int64{"eth_blockNumber": 1},
+		},
+		{
+			name:    "equal",
+			weights: map[string]int64{"eth_call": 7, "eth_getBalance": 7, "eth_blockNumber": 7, "net_version": 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gen, err := MakeQueriesGenerator(tt.weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var total int64
+			for _, w := range tt.weights {
+				total += w
+			}
+
+			s := NewSyntheticState(42, 15000000, 0)
+			counts := map[string]int{}
+			for i := 0; i < draws; i++ {
+				q, err := gen.Query(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				counts[q.Method]++
+			}
+
+			for method, weight := range tt.weights {
+				want := float64(weight) / float64(total)
+				got := float64(counts[method]) / draws
+				if math.Abs(got-want) > tolerance {
+					t.Errorf("%s: got frequency %.4f, want %.4f", method, got, want)
+				}
+			}
+			for method := range counts {
+				if _, ok := tt.weights[method]; !ok {
+					t.Errorf("%s was drawn without a weight", method)
+				}
+			}
+		})
+	}
+}
+
+func TestMakeQueriesGeneratorNegativeWeight(t *testing.T) {
+	if _, err := MakeQueriesGenerator(map[string]int64{"eth_call": 10, "eth_getBalance": -1}); err == nil {
+		t.Error("expected an error for a negative weight")
+	}
+}
+
+// BenchmarkQuery renders every method into a reused buffer, the way queries
+// are printed. Allocations per op are those of generating the query.
+func BenchmarkQuery(b *testing.B) {
+	generators := map[string]Generator{}
+	for method, generate := range rpcMethod {
+		generators[method] = generate
+	}
+	for method, tuned := range tunedMethod {
+		generators[method] = tuned(MethodProfile{}.withDefaults())
+	}
+	methods := make([]string, 0, len(generators))
+	for method := range generators {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	for _, method := range methods {
+		generate := generators[method]
+		b.Run(method, func(b *testing.B) {
+			s := NewSyntheticState(42, 15000000, 0)
+			var body []byte
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q := generate(s)
+				body = q.AppendBody(body[:0])
+			}
+			b.SetBytes(int64(len(body)))
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package ethspam
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/INFURA/go-ethlibs/node"
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/sha3"
+)
+
+// Transfers sent by a Wallet: 1 wei to an address from the state
+const (
+	transferGas   = 21000
+	transferValue = 1
+)
+
+// runtimeMethods have no static generator, they are generated from sources
+// configured at startup and passed to MakeProfileQueriesGenerator.
+var runtimeMethods = map[string]bool{
+	"eth_sendRawTransaction": true,
+	"trace_rawTransaction":   true,
+}
+
+// Wallet generates eth_sendRawTransaction queries of transfers signed with
+// funded keys, in turn. Nonces are counted locally from the pending nonce of
+// each account, see Sync. Goroutine-safe.
+type Wallet struct {
+	ChainID  uint64
+	GasPrice uint64
+	// Sending is set when the transactions are sent to the endpoint the
+	// nonces are synced with, rather than printed. Stuck accounts are only
+	// restarted then, as the pending nonce of printed ones never moves.
+	Sending bool
+
+	mu       sync.Mutex
+	accounts []*walletAccount
+	next     int
+}
+
+type walletAccount struct {
+	key     *btcec.PrivateKey
+	address string
+	nonce   uint64 // next nonce to use
+	pending uint64 // pending nonce of the endpoint at the last sync
+}
+
+// NewWallet returns a Wallet for hex private keys on the chain, paying the
+// given gas price.
+func NewWallet(keys []string, chainID, gasPrice uint64) (*Wallet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys")
+	}
+	w := &Wallet{ChainID: chainID, GasPrice: gasPrice}
+	for _, k := range keys {
+		b, err := hex.DecodeString(strings.TrimPrefix(k, "0x"))
+		if err != nil || len(b) != 32 {
+			return nil, errors.New("keys must be 32 bytes of hex")
+		}
+		key, pub := btcec.PrivKeyFromBytes(btcec.S256(), b)
+		w.accounts = append(w.accounts, &walletAccount{
+			key:     key,
+			address: "0x" + hex.EncodeToString(keccak256(pub.SerializeUncompressed()[1:])[12:]),
+		})
+	}
+	return w, nil
+}
+
+// Sync fetches the pending nonce of every account. When Sending, accounts
+// whose pending nonce hasn't moved since the last sync are stuck behind a
+// nonce that never made it to the pool, so their local nonce is reset to fill
+// the gap.
+func (w *Wallet) Sync(ctx context.Context, client node.Client) error {
+	for _, a := range w.accounts {
+		pending, err := requestQuantity(ctx, client, "eth_getTransactionCount", a.address, "pending")
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		if pending > a.nonce || (w.Sending && pending == a.pending && pending < a.nonce) {
+			a.nonce = pending
+		}
+		a.pending = pending
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+// Generate returns an eth_sendRawTransaction query with the next transfer.
+func (w *Wallet) Generate(s State) QueryContent {
+	raw := w.transfer(s, true)
+	return QueryContent{
+		Id:     s.ID(),
+		Method: "eth_sendRawTransaction",
+		Params: stringParams(raw),
+	}
+}
+
+// RawTransaction returns a transfer signed with the next nonce of an account
+// without using it up, for simulations such as trace_rawTransaction.
+func (w *Wallet) RawTransaction(s State) string {
+	return w.transfer(s, false)
+}
+
+// transfer signs a transfer from the next account, using up its nonce if it
+// is sent.
+func (w *Wallet) transfer(s State, send bool) string {
+	to := s.RandomAddress()
+
+	w.mu.Lock()
+	a := w.accounts[w.next]
+	w.next = (w.next + 1) % len(w.accounts)
+	nonce := a.nonce
+	if send {
+		a.nonce++
+	}
+	w.mu.Unlock()
+
+	if to == "" {
+		to = a.address
+	}
+	raw, err := w.sign(a, nonce, to)
+	if err != nil {
+		// Only the recipient can be malformed, such as an address from a
+		// loaded snapshot, so send to the account itself instead
+		raw, _ = w.sign(a, nonce, a.address)
+	}
+	return "0x" + hex.EncodeToString(raw)
+}
+
+// sign returns the RLP encoding of a legacy transfer signed for the chain as
+// specified by EIP-155.
+func (w *Wallet) sign(a *walletAccount, nonce uint64, to string) ([]byte, error) {
+	toBytes, err := hex.DecodeString(strings.TrimPrefix(to, "0x"))
+	if err != nil || len(toBytes) != 20 {
+		return nil, fmt.Errorf("invalid address: %s", to)
+	}
+	fields := [][]byte{
+		rlpUint(nonce),
+		rlpUint(w.GasPrice),
+		rlpUint(transferGas),
+		rlpBytes(toBytes),
+		rlpUint(transferValue),
+		rlpBytes(nil),
+	}
+	hash := keccak256(rlpList(append(fields, rlpUint(w.ChainID), rlpUint(0), rlpUint(0))...))
+	sig, err := btcec.SignCompact(btcec.S256(), a.key, hash, false)
+	if err != nil {
+		return nil, err
+	}
+	recovery := uint64(sig[0] - 27)
+	return rlpList(append(fields,
+		rlpUint(w.ChainID*2+35+recovery),
+		rlpBytes(trimZeros(sig[1:33])),
+		rlpBytes(trimZeros(sig[33:65])),
+	)...), nil
+}
+
+// RawTransactions replays pre-signed transactions as eth_sendRawTransaction
+// queries, in order and wrapping around at the end. Goroutine-safe.
+type RawTransactions struct {
+	txs  []string
+	next uint64
+}
+
+// LoadRawTransactions reads hex encoded signed transactions, one per line.
+func LoadRawTransactions(r io.Reader) (*RawTransactions, error) {
+	lines, err := ReadLines(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("no transactions")
+	}
+	for i, line := range lines {
+		if _, err := hex.DecodeString(strings.TrimPrefix(line, "0x")); err != nil {
+			return nil, fmt.Errorf("transaction on line %d is not hex", i+1)
+		}
+		if !strings.HasPrefix(line, "0x") {
+			lines[i] = "0x" + line
+		}
+	}
+	return &RawTransactions{txs: lines}, nil
+}
+
+// Generate returns an eth_sendRawTransaction query with the next transaction.
+func (t *RawTransactions) Generate(s State) QueryContent {
+	return QueryContent{
+		Id:     s.ID(),
+		Method: "eth_sendRawTransaction",
+		Params: stringParams(t.RawTransaction(s)),
+	}
+}
+
+// RawTransaction returns the next transaction.
+func (t *RawTransactions) RawTransaction(s State) string {
+	n := atomic.AddUint64(&t.next, 1) - 1
+	return t.txs[n%uint64(len(t.txs))]
+}
+
+// ReadLines returns the non-empty lines of r, without surrounding spaces and
+// skipping # comments.
+func ReadLines(r io.Reader) ([]string, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// GasPrice asks the endpoint for its gas price with eth_gasPrice.
+func GasPrice(ctx context.Context, client node.Client) (uint64, error) {
+	return requestQuantity(ctx, client, "eth_gasPrice")
+}
+
+func keccak256(data []byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func trimZeros(b []byte) []byte {
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+// rlpBytes encodes a byte string in RLP.
+func rlpBytes(b []byte) []byte {
+	if len(b) == 1 && b[0] < 0x80 {
+		return b
+	}
+	return append(rlpHeader(0x80, len(b)), b...)
+}
+
+// rlpUint encodes an integer in RLP, as a big-endian byte string without
+// leading zeros.
+func rlpUint(n uint64) []byte {
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return rlpBytes(b)
+}
+
+// rlpList encodes a list of RLP encoded items.
+func rlpList(items ...[]byte) []byte {
+	var payload []byte
+	for _, item := range items {
+		payload = append(payload, item...)
+	}
+	return append(rlpHeader(0xc0, len(payload)), payload...)
+}
+
+func rlpHeader(offset byte, size int) []byte {
+	if size < 56 {
+		return []byte{offset + byte(size)}
+	}
+	var length []byte
+	for n := size; n > 0; n >>= 8 {
+		length = append([]byte{byte(n)}, length...)
+	}
+	return append([]byte{offset + 55 + byte(len(length))}, length...)
+}
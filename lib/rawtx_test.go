@@ -0,0 +1,197 @@
+package ethspam
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+const testKey = "0x4646464646464646464646464646464646464646464646464646464646464646"
+
+func TestNewWalletAddress(t *testing.T) {
+	w, err := NewWallet([]string{testKey}, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := w.accounts[0].address, "0x9d8a62f656a8d1615c1294fd71e9cfb3e4855a4f"; got != want {
+		t.Errorf("address: got %s, want %s", got, want)
+	}
+
+	for _, keys := range [][]string{nil, {"0x46"}, {"0x" + strings.Repeat("zz", 32)}} {
+		if _, err := NewWallet(keys, 1, 1); err == nil {
+			t.Errorf("expected an error for keys %q", keys)
+		}
+	}
+}
+
+func TestWalletSign(t *testing.T) {
+	const to = "0x3535353535353535353535353535353535353535"
+	for _, chainID := range []uint64{1, 5, 1337} {
+		w, err := NewWallet([]string{testKey}, chainID, 20000000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := w.accounts[0]
+		raw, err := w.sign(a, 9, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fields, err := rlpDecodeList(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fields) != 9 {
+			t.Fatalf("chain %d: got %d fields, want 9", chainID, len(fields))
+		}
+		want := [][]byte{rlpUint(9), rlpUint(20000000000), rlpUint(transferGas), rlpBytes(mustDecodeHex(to)), rlpUint(transferValue), rlpBytes(nil)}
+		for i, field := range want {
+			if !bytes.Equal(rlpBytes(fields[i]), field) {
+				t.Errorf("chain %d: field %d: got %x, want %x", chainID, i, rlpBytes(fields[i]), field)
+			}
+		}
+
+		// Recover the sender from the EIP-155 signing hash and v
+		v := decodeUint(fields[6])
+		recovery := v - chainID*2 - 35
+		if recovery > 1 {
+			t.Fatalf("chain %d: v %d is not for the chain", chainID, v)
+		}
+		hash := keccak256(rlpList(append(want, rlpUint(chainID), rlpUint(0), rlpUint(0))...))
+		sig := make([]byte, 65)
+		sig[0] = byte(27 + recovery)
+		copy(sig[33-len(fields[7]):33], fields[7])
+		copy(sig[65-len(fields[8]):], fields[8])
+		pub, _, err := btcec.RecoverCompact(btcec.S256(), sig, hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := "0x" + hex.EncodeToString(keccak256(pub.SerializeUncompressed()[1:])[12:]); got != a.address {
+			t.Errorf("chain %d: recovered sender %s, want %s", chainID, got, a.address)
+		}
+	}
+
+	w, _ := NewWallet([]string{testKey}, 1, 1)
+	if _, err := w.sign(w.accounts[0], 0, "0x1234"); err == nil {
+		t.Error("expected an error for a short address")
+	}
+}
+
+// TestRLPSigningData encodes the example transaction of EIP-155 for signing.
+func TestRLPSigningData(t *testing.T) {
+	data := rlpList(
+		rlpUint(9),
+		rlpUint(20000000000),
+		rlpUint(21000),
+		rlpBytes(bytes.Repeat([]byte{0x35}, 20)),
+		rlpUint(1000000000000000000),
+		rlpBytes(nil),
+		rlpUint(1), rlpUint(0), rlpUint(0),
+	)
+	if got, want := hex.EncodeToString(data), "ec098504a817c800825208943535353535353535353535353535353535353535880de0b6b3a764000080018080"; got != want {
+		t.Errorf("signing data: got %s, want %s", got, want)
+	}
+	if got, want := hex.EncodeToString(keccak256(data)), "daf5a779ae972f972197303d7b574746c7ef83eadac0f2791ad23db92e4c8e53"; got != want {
+		t.Errorf("signing hash: got %s, want %s", got, want)
+	}
+}
+
+func TestRLPHeader(t *testing.T) {
+	tests := []struct {
+		size  int
+		bytes string
+		list  string
+	}{
+		{0, "80", "c0"},
+		{55, "b7", "f7"},
+		{56, "b838", "f838"},
+		{255, "b8ff", "f8ff"},
+		{256, "b90100", "f90100"},
+		{1024, "b90400", "f90400"},
+	}
+	for _, tt := range tests {
+		payload := bytes.Repeat([]byte{0xaa}, tt.size)
+		if got := hex.EncodeToString(rlpBytes(payload)); got != tt.bytes+strings.Repeat("aa", tt.size) {
+			t.Errorf("string of %d bytes: got header %s, want %s", tt.size, got[:len(got)-2*tt.size], tt.bytes)
+		}
+		if got := hex.EncodeToString(rlpList(payload)); got != tt.list+strings.Repeat("aa", tt.size) {
+			t.Errorf("list of %d bytes: got header %s, want %s", tt.size, got[:len(got)-2*tt.size], tt.list)
+		}
+	}
+
+	if got := rlpBytes([]byte{0x7f}); !bytes.Equal(got, []byte{0x7f}) {
+		t.Errorf("single byte: got %x, want 7f", got)
+	}
+	if got := rlpUint(0); !bytes.Equal(got, []byte{0x80}) {
+		t.Errorf("zero: got %x, want 80", got)
+	}
+}
+
+// rlpDecodeList returns the byte strings of an RLP list of byte strings.
+func rlpDecodeList(b []byte) ([][]byte, error) {
+	payload, rest, err := rlpSplit(b, 0xc0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errRLP
+	}
+	var items [][]byte
+	for len(payload) > 0 {
+		if payload[0] < 0x80 {
+			items = append(items, payload[:1])
+			payload = payload[1:]
+			continue
+		}
+		var item []byte
+		item, payload, err = rlpSplit(payload, 0x80)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+var errRLP = errors.New("malformed RLP")
+
+// rlpSplit returns the payload of the item at the start of b with the given
+// header offset, and the bytes after it.
+func rlpSplit(b []byte, offset byte) (payload, rest []byte, err error) {
+	if len(b) == 0 || b[0] < offset || (offset == 0x80 && b[0] >= 0xc0) {
+		return nil, nil, errRLP
+	}
+	size, b := int(b[0]-offset), b[1:]
+	if size > 55 {
+		n := size - 55
+		if len(b) < n {
+			return nil, nil, errRLP
+		}
+		size = int(decodeUint(b[:n]))
+		b = b[n:]
+	}
+	if len(b) < size {
+		return nil, nil, errRLP
+	}
+	return b[:size], b[size:], nil
+}
+
+func decodeUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
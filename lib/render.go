@@ -0,0 +1,96 @@
+package ethspam
+
+import "strconv"
+
+// Queries are rendered by appending to byte slices rather than with fmt,
+// which boxes every argument and allocates on each call. Generators append
+// their params to a buffer on their stack and AppendBody writes into the
+// caller's reusable buffer. Queries still aren't free: the Params string is
+// allocated for each one, as are some of the values generators draw.
+
+// AppendBody appends the query as a JSON object on a single line to dst.
+func (q *QueryContent) AppendBody(dst []byte) []byte {
+	return append(q.appendObject(dst), '\n')
+}
+
+func (q *QueryContent) appendObject(dst []byte) []byte {
+	dst = append(dst, `{"jsonrpc":"2.0","id":`...)
+	dst = strconv.AppendInt(dst, q.Id, 10)
+	dst = append(dst, `,"method":"`...)
+	dst = append(dst, q.Method...)
+	dst = append(dst, `","params":`...)
+	dst = append(dst, q.Params...)
+	return append(dst, '}')
+}
+
+// AppendBody appends the batch as a JSON array on a single line to dst.
+func (b Batch) AppendBody(dst []byte) []byte {
+	dst = append(dst, '[')
+	for i := range b {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = b[i].appendObject(dst)
+	}
+	return append(dst, "]\n"...)
+}
+
+// appendString appends s as a JSON string. Generated values are hex or tags,
+// which never need escaping.
+func appendString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	dst = append(dst, s...)
+	return append(dst, '"')
+}
+
+// appendQuantity appends n as a hex JSON quantity such as "0x1b4".
+func appendQuantity(dst []byte, n uint64) []byte {
+	dst = append(dst, `"0x`...)
+	dst = strconv.AppendUint(dst, n, 16)
+	return append(dst, '"')
+}
+
+// stringParams returns params with a single string.
+func stringParams(s string) string {
+	return `["` + s + `"]`
+}
+
+// blockParams returns the params of a block by number, with or without
+// full transactions.
+func blockParams(n uint64, full bool) string {
+	var buf [32]byte
+	b := append(buf[:0], '[')
+	b = appendQuantity(b, n)
+	b = append(b, ',')
+	b = strconv.AppendBool(b, full)
+	b = append(b, ']')
+	return string(b)
+}
+
+// callParams returns the params of eth_call style methods: a call object and
+// the block to run it in.
+func callParams(to, from, input string, block uint64) string {
+	var buf [512]byte
+	b := append(buf[:0], '[')
+	b = appendCall(b, to, from, input)
+	b = append(b, ',')
+	b = appendQuantity(b, block)
+	b = append(b, ']')
+	return string(b)
+}
+
+// appendCall appends a call object, leaving out the recipient of contract
+// creations.
+func appendCall(dst []byte, to, from, input string) []byte {
+	dst = append(dst, '{')
+	if to != "" {
+		dst = append(dst, `"to":`...)
+		dst = appendString(dst, to)
+		dst = append(dst, ',')
+	}
+	dst = append(dst, `"from":`...)
+	dst = appendString(dst, from)
+	dst = append(dst, `,"data":`...)
+	dst = appendString(dst, input)
+	return append(dst, '}')
+}
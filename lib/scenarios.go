@@ -0,0 +1,355 @@
+package ethspam
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxReadySteps bounds the follow-up queries waiting in a Journey. Responses
+// that fan out beyond it are cut short.
+const maxReadySteps = 10000
+
+// Scenario is a user journey: a sequence of queries where each step can take
+// its params from the response to the previous one, such as a wallet reading
+// the latest block and then the receipts of its transactions.
+type Scenario struct {
+	Weight int64          `json:"weight"`
+	Steps  []ScenarioStep `json:"steps"`
+}
+
+// ScenarioStep is a query of a Scenario. Its params are JSON in which strings
+// starting with $ are references: $address, $contract, $transaction, $block
+// and $blockHash take a value from the state, $result takes the result of the
+// previous step and $result.path a field of it, such as $result.hash or
+// $result.transactions.0. A step whose references go through an array, such
+// as $result.transactions[].hash, is made once for each element.
+type ScenarioStep struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+	// Limit is the most queries a step fans out to, all if zero
+	Limit int `json:"limit,omitempty"`
+}
+
+func (sc Scenario) validate() error {
+	if sc.Weight < 0 {
+		return errors.New("negative weight")
+	}
+	_, err := compileSteps(sc.Steps)
+	return err
+}
+
+// Journey generates the queries of a Scenario. Steps that follow a response
+// are generated before new journeys are started, so the journeys in flight
+// settle where their queries match the rate of the generator. Queries that
+// are never answered, such as printed ones, end their journey. Goroutine-safe,
+// and shared by all the states.
+type Journey struct {
+	Name string
+
+	steps []*journeyStep
+
+	mu    sync.Mutex
+	ready []readyStep
+}
+
+// NewJourney returns the Journey of the scenario, naming its queries after the
+// scenario and their method.
+func NewJourney(name string, sc Scenario) (*Journey, error) {
+	steps, err := compileSteps(sc.Steps)
+	if err != nil {
+		return nil, fmt.Errorf("scenario %s: %s", name, err)
+	}
+	j := &Journey{Name: name, steps: steps}
+	for _, step := range steps {
+		step.journey = j
+		step.name = name + "/" + step.Method
+	}
+	return j, nil
+}
+
+// Generate returns the next step of a journey in flight, or the first step of
+// a new one.
+func (j *Journey) Generate(s State) QueryContent {
+	r := readyStep{step: j.steps[0]}
+	j.mu.Lock()
+	if len(j.ready) > 0 {
+		r = j.ready[0]
+		j.ready[0] = readyStep{}
+		j.ready = j.ready[1:]
+	}
+	j.mu.Unlock()
+
+	q := QueryContent{
+		Id:     s.ID(),
+		Method: r.step.Method,
+		Params: r.step.params.render(s, r.result, r.element),
+		Name:   r.step.name,
+	}
+	if r.step.index+1 < len(j.steps) {
+		q.Responder = r.step
+	}
+	return q
+}
+
+// readyStep is a step waiting to be generated with the response it follows.
+type readyStep struct {
+	step    *journeyStep
+	result  interface{}
+	element interface{}
+}
+
+type journeyStep struct {
+	ScenarioStep
+	journey *Journey
+	index   int
+	name    string
+	params  paramsTemplate
+}
+
+func compileSteps(steps []ScenarioStep) ([]*journeyStep, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("no steps")
+	}
+	compiled := make([]*journeyStep, len(steps))
+	for i, step := range steps {
+		if step.Method == "" {
+			return nil, fmt.Errorf("step %d has no method", i+1)
+		}
+		if step.Limit < 0 {
+			return nil, fmt.Errorf("step %d: limit must not be negative", i+1)
+		}
+		params, err := compileParams(step.Params)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %s", i+1, err)
+		}
+		if i == 0 && params.usesResult {
+			return nil, errors.New("the first step has no previous result")
+		}
+		compiled[i] = &journeyStep{ScenarioStep: step, index: i, params: params}
+	}
+	return compiled, nil
+}
+
+// Respond queues the next step of the journey with the result, once for each
+// element if it fans out. Failed queries and empty results end the journey.
+func (step *journeyStep) Respond(q QueryContent, result json.RawMessage, err error) {
+	if err != nil || len(result) == 0 {
+		return
+	}
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(result))
+	dec.UseNumber()
+	if dec.Decode(&value) != nil || value == nil {
+		return
+	}
+
+	next := step.journey.steps[step.index+1]
+	ready := []readyStep{{step: next, result: value}}
+	if next.params.fanOut != nil {
+		elements, _ := lookup(value, next.params.fanOut).([]interface{})
+		if next.Limit > 0 && len(elements) > next.Limit {
+			elements = elements[:next.Limit]
+		}
+		ready = make([]readyStep, len(elements))
+		for i, element := range elements {
+			ready[i] = readyStep{step: next, result: value, element: element}
+		}
+	}
+
+	j := step.journey
+	j.mu.Lock()
+	if room := maxReadySteps - len(j.ready); len(ready) > room {
+		ready = ready[:room]
+	}
+	j.ready = append(j.ready, ready...)
+	j.mu.Unlock()
+}
+
+// stateRefs are the references to values drawn from the state.
+var stateRefs = map[string]func(State) string{
+	"$address":     State.RandomAddress,
+	"$transaction": State.RandomTransaction,
+	"$blockHash":   State.RandomBlock,
+	"$contract": func(s State) string {
+		addr, _ := s.RandomContract()
+		return addr
+	},
+	"$block": func(s State) string {
+		return "0x" + strconv.FormatUint(s.CurrentBlock(), 16)
+	},
+}
+
+// paramsTemplate is the params of a step split around its references: parts
+// are the literal JSON before each hole, with one more part after the last.
+type paramsTemplate struct {
+	parts []string
+	holes []paramHole
+
+	usesResult bool
+	// fanOut is the path to the array the step is made for each element of
+	fanOut []string
+}
+
+type paramHole struct {
+	state func(State) string
+	// path into the result, or into the element when fanning out
+	path    []string
+	element bool
+}
+
+func compileParams(raw json.RawMessage) (paramsTemplate, error) {
+	var t paramsTemplate
+	if len(raw) == 0 {
+		t.parts = []string{"[]"}
+		return t, nil
+	}
+	var params interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&params); err != nil {
+		return t, err
+	}
+	if _, ok := params.([]interface{}); !ok {
+		return t, errors.New("params must be an array")
+	}
+	b, err := t.compile(nil, params)
+	if err != nil {
+		return t, err
+	}
+	t.parts = append(t.parts, string(b))
+	return t, nil
+}
+
+// compile appends the value as JSON to b, cutting a part at every reference.
+func (t *paramsTemplate) compile(b []byte, v interface{}) ([]byte, error) {
+	var err error
+	switch v := v.(type) {
+	case []interface{}:
+		b = append(b, '[')
+		for i, item := range v {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			if b, err = t.compile(b, item); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, ']'), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b = append(b, '{')
+		for i, key := range keys {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			k, _ := json.Marshal(key)
+			b = append(append(b, k...), ':')
+			if b, err = t.compile(b, v[key]); err != nil {
+				return nil, err
+			}
+		}
+		return append(b, '}'), nil
+	case string:
+		if strings.HasPrefix(v, "$") {
+			hole, err := t.parseHole(v)
+			if err != nil {
+				return nil, err
+			}
+			t.parts = append(t.parts, string(b))
+			t.holes = append(t.holes, hole)
+			return b[:0], nil
+		}
+	}
+	literal, err := json.Marshal(v)
+	return append(b, literal...), err
+}
+
+func (t *paramsTemplate) parseHole(ref string) (paramHole, error) {
+	if state, ok := stateRefs[ref]; ok {
+		return paramHole{state: state}, nil
+	}
+	if ref != "$result" && !strings.HasPrefix(ref, "$result.") {
+		return paramHole{}, errors.New("unknown reference " + ref)
+	}
+	t.usesResult = true
+	path := strings.TrimPrefix(strings.TrimPrefix(ref, "$result"), ".")
+	parts := strings.Split(path, "[]")
+	switch len(parts) {
+	case 1:
+		return paramHole{path: splitPath(path)}, nil
+	case 2:
+		fanOut := splitPath(parts[0])
+		if t.fanOut != nil && strings.Join(t.fanOut, ".") != strings.Join(fanOut, ".") {
+			return paramHole{}, errors.New("a step can only fan out over one array")
+		}
+		t.fanOut = fanOut
+		return paramHole{path: splitPath(strings.TrimPrefix(parts[1], ".")), element: true}, nil
+	}
+	return paramHole{}, errors.New("nested arrays are not supported in " + ref)
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, ".")
+}
+
+// render returns the params with the references filled in.
+func (t *paramsTemplate) render(s State, result, element interface{}) string {
+	if len(t.holes) == 0 {
+		return t.parts[0]
+	}
+	var arr [256]byte
+	b := arr[:0]
+	for i, hole := range t.holes {
+		b = append(b, t.parts[i]...)
+		switch {
+		case hole.state != nil:
+			b = appendString(b, hole.state(s))
+		case hole.element:
+			b = appendValue(b, lookup(element, hole.path))
+		default:
+			b = appendValue(b, lookup(result, hole.path))
+		}
+	}
+	return string(append(b, t.parts[len(t.parts)-1]...))
+}
+
+// lookup returns the value at the path of object keys and array indexes, or
+// nil if there is none.
+func lookup(v interface{}, path []string) interface{} {
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func appendValue(b []byte, v interface{}) []byte {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return append(b, "null"...)
+	}
+	return append(b, value...)
+}
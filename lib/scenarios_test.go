@@ -0,0 +1,190 @@
+package ethspam
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestParamsTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  string
+		result  string
+		element string // JSON of the fanned out element, if any
+		want    string
+	}{
+		{
+			name: "no params",
+			want: `[]`,
+		},
+		{
+			name:   "literals",
+			params: `["latest", false, {"b": 1, "a": [2]}]`,
+			want:   `["latest",false,{"a":[2],"b":1}]`,
+		},
+		{
+			name:   "result",
+			params: `["$result"]`,
+			result: `"0x10"`,
+			want:   `["0x10"]`,
+		},
+		{
+			name:   "result path",
+			params: `["$result.hash", true]`,
+			result: `{"hash": "0xab", "number": "0x1"}`,
+			want:   `["0xab",true]`,
+		},
+		{
+			name:   "array index",
+			params: `["$result.transactions.1"]`,
+			result: `{"transactions": ["0x1", "0x2"]}`,
+			want:   `["0x2"]`,
+		},
+		{
+			name:   "missing path",
+			params: `["$result.transactions.2", "$result.nope.0"]`,
+			result: `{"transactions": ["0x1", "0x2"]}`,
+			want:   `[null,null]`,
+		},
+		{
+			name:   "numbers and objects",
+			params: `[{"to": "$result.to", "gas": "$result.gas"}, "$result.log"]`,
+			result: `{"to": "0xcc", "gas": 21000, "log": {"topics": ["0x1"]}}`,
+			want:   `[{"gas":21000,"to":"0xcc"},{"topics":["0x1"]}]`,
+		},
+		{
+			name:    "element path",
+			params:  `["$result.transactions[].hash", "$result.number"]`,
+			result:  `{"number": "0x5", "transactions": [{"hash": "0xa"}, {"hash": "0xb"}]}`,
+			element: `{"hash": "0xb"}`,
+			want:    `["0xb","0x5"]`,
+		},
+		{
+			name:    "whole element",
+			params:  `["$result.transactions[]", "$result.transactions[]"]`,
+			result:  `{"transactions": ["0xa"]}`,
+			element: `"0xa"`,
+			want:    `["0xa","0xa"]`,
+		},
+		{
+			name:   "state block",
+			params: `["$block", "$result"]`,
+			result: `1`,
+			want:   `["0xe4e1c0",1]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := compileParams(json.RawMessage(tt.params))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := NewSyntheticState(42, 15000000, 0)
+			got := params.render(s, decodeJSON(t, tt.result), decodeJSON(t, tt.element))
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParamsTemplateState(t *testing.T) {
+	params, err := compileParams(json.RawMessage(`["$address", {"to": "$contract"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.usesResult {
+		t.Error("state references are taken for the result")
+	}
+
+	// Holes are filled in order, so a twin state draws the same values
+	twin := NewSyntheticState(42, 15000000, 0)
+	address := twin.RandomAddress()
+	contract, _ := twin.RandomContract()
+	want := `["` + address + `",{"to":"` + contract + `"}]`
+	if got := params.render(NewSyntheticState(42, 15000000, 0), nil, nil); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestCompileParamsErrors(t *testing.T) {
+	tests := []struct {
+		params string
+		err    string
+	}{
+		{`{"a": 1}`, "params must be an array"},
+		{`["$nope"]`, "unknown reference $nope"},
+		{`["$results"]`, "unknown reference $results"},
+		{`["$result.a[].x", "$result.b[].y"]`, "a step can only fan out over one array"},
+		{`["$result.a[].b[]"]`, "nested arrays are not supported in $result.a[].b[]"},
+		{`["$result"`, "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		_, err := compileParams(json.RawMessage(tt.params))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%s: got error %v, want %q", tt.params, err, tt.err)
+		}
+	}
+
+	if _, err := compileSteps([]ScenarioStep{{Method: "eth_getBlockByHash", Params: json.RawMessage(`["$result.hash"]`)}}); err == nil {
+		t.Error("expected an error for a first step using the previous result")
+	}
+}
+
+func TestJourneyFanOut(t *testing.T) {
+	j, err := NewJourney("wallet", Scenario{Steps: []ScenarioStep{
+		{Method: "eth_getBlockByNumber", Params: json.RawMessage(`["latest", false]`)},
+		{Method: "eth_getTransactionReceipt", Params: json.RawMessage(`["$result.transactions[]"]`), Limit: 2},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSyntheticState(42, 15000000, 0)
+
+	first := j.Generate(s)
+	if first.Method != "eth_getBlockByNumber" || first.Params != `["latest",false]` || first.Name != "wallet/eth_getBlockByNumber" {
+		t.Fatalf("first step: got %+v", first)
+	}
+	if first.Responder == nil {
+		t.Fatal("the first step has no responder")
+	}
+	first.Answer(json.RawMessage(`{"transactions": ["0x1", "0x2", "0x3"]}`), nil)
+
+	// Limited to the first two transactions
+	for _, want := range []string{`["0x1"]`, `["0x2"]`} {
+		q := j.Generate(s)
+		if q.Method != "eth_getTransactionReceipt" || q.Params != want {
+			t.Errorf("fanned out step: got %s %s, want %s", q.Method, q.Params, want)
+		}
+		if q.Responder != nil {
+			t.Error("the last step has a responder")
+		}
+	}
+	if q := j.Generate(s); q.Method != "eth_getBlockByNumber" {
+		t.Errorf("after the fan out: got %s, want a new journey", q.Method)
+	}
+
+	// Failed and empty responses end the journey
+	first.Answer(json.RawMessage(`{"transactions": ["0x1"]}`), &RPCError{Code: -32000})
+	first.Answer(json.RawMessage(`null`), nil)
+	first.Answer(json.RawMessage(`{"transactions": []}`), nil)
+	if q := j.Generate(s); q.Method != "eth_getBlockByNumber" {
+		t.Errorf("after failed responses: got %s, want a new journey", q.Method)
+	}
+}
+
+// decodeJSON decodes a result the way responses are decoded, or returns nil
+// for an empty string.
+func decodeJSON(t *testing.T, s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
@@ -0,0 +1,51 @@
+package ethspam
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/INFURA/go-ethlibs/eth"
+)
+
+// snapshot is the on-disk JSON representation of a LiveState.
+type snapshot struct {
+	CurrentBlock uint64            `json:"currentBlock"`
+	Transactions []eth.Transaction `json:"transactions"`
+	BlockHashes  map[uint64]string `json:"blockHashes"`
+	Contracts    []Contract        `json:"contracts,omitempty"`
+}
+
+// Save writes the state dataset as JSON, to be read back with LoadState.
+func (s *LiveState) Save(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snapshot{
+		CurrentBlock: s.currentBlock,
+		Transactions: s.transactions,
+		BlockHashes:  s.blockHashes,
+		Contracts:    s.Contracts(),
+	})
+}
+
+// LoadState reads a state dataset written by LiveState.Save. The IdGen and
+// RandSrc of the returned state must be set by the caller.
+func LoadState(r io.Reader) (*LiveState, error) {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+	if snap.CurrentBlock == 0 || len(snap.Transactions) == 0 {
+		return nil, errors.New("state snapshot is missing the current block or transactions")
+	}
+	if snap.BlockHashes == nil {
+		snap.BlockHashes = map[uint64]string{}
+	}
+	return &LiveState{
+		currentBlock: snap.CurrentBlock,
+		transactions: snap.Transactions,
+		blockHashes:  snap.BlockHashes,
+		blocks:       sortedBlocks(snap.BlockHashes),
+		contracts:    snap.Contracts,
+	}, nil
+}
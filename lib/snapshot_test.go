@@ -0,0 +1,72 @@
+package ethspam
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/INFURA/go-ethlibs/eth"
+)
+
+func TestSaveLoadState(t *testing.T) {
+	to := eth.Address("0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2")
+	number := eth.QuantityFromUInt64(100)
+	state := &LiveState{
+		currentBlock: 101,
+		transactions: []eth.Transaction{
+			{
+				Hash:        "0x88df016429689c079f3b2f6ad39fa052532c56795b733da78a91ebe6a713944b",
+				BlockNumber: &number,
+				From:        "0xa7d9ddbe1f17865597fbd27ec712455208b6b76d",
+				To:          &to,
+				Input:       "0x70a08231",
+				Value:       eth.QuantityFromUInt64(1),
+			},
+		},
+		blockHashes: map[uint64]string{
+			100: "0xb3b20624f8f0f86eb50dd04688409e5cea4bd02d700bf6e79e9384d47d6a5a35",
+			101: "0x1d59ff54b1eb26b013ce3cb5fc9dab3705b415a67127a003c3e61eb445bb8df2",
+		},
+		contracts: []Contract{{Addr: string(to), Topics: []string{"0xddf252ad1be2c89b69c2b068fc378daa952ba7f163c4a11628f55a4df523b3ef"}}},
+	}
+
+	var saved bytes.Buffer
+	if err := state.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadState(bytes.NewReader(saved.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.currentBlock != state.currentBlock {
+		t.Errorf("current block: got %d, want %d", loaded.currentBlock, state.currentBlock)
+	}
+	if len(loaded.transactions) != 1 || loaded.transactions[0].Hash != state.transactions[0].Hash {
+		t.Errorf("transactions: got %+v, want %+v", loaded.transactions, state.transactions)
+	}
+	if !reflect.DeepEqual(loaded.blockHashes, state.blockHashes) {
+		t.Errorf("block hashes: got %v, want %v", loaded.blockHashes, state.blockHashes)
+	}
+	if want := []uint64{100, 101}; !reflect.DeepEqual(loaded.blocks, want) {
+		t.Errorf("blocks: got %v, want %v", loaded.blocks, want)
+	}
+	if !reflect.DeepEqual(loaded.contracts, state.contracts) {
+		t.Errorf("contracts: got %v, want %v", loaded.contracts, state.contracts)
+	}
+
+	// Saving the loaded state again gives back the same snapshot
+	var resaved bytes.Buffer
+	if err := loaded.Save(&resaved); err != nil {
+		t.Fatal(err)
+	}
+	if resaved.String() != saved.String() {
+		t.Errorf("saved again:\n%s\nwant:\n%s", resaved.String(), saved.String())
+	}
+}
+
+func TestLoadStateEmpty(t *testing.T) {
+	if _, err := LoadState(bytes.NewBufferString(`{"currentBlock": 1, "transactions": []}`)); err == nil {
+		t.Error("expected an error for a snapshot without transactions")
+	}
+}
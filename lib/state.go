@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"math/rand"
+	"sort"
+	"strconv"
 	"sync/atomic"
 
 	"github.com/INFURA/go-ethlibs/eth"
@@ -12,7 +14,15 @@ import (
 
 var ErrEmptyBlock = errors.New("the sampled block is empty")
 
+// ErrSameHead is returned by Refresh when the latest block is still the
+// current block of the old state, which is then up to date.
+var ErrSameHead = errors.New("the latest block hasn't changed")
+
+// State is the dataset queries are generated from. States are immutable once
+// produced, except for their random source: Fork gives every goroutine a view
+// with its own, sharing the data and the IDs.
 type State interface {
+	Fork(randSrc rand.Source) State
 	RandInt64() int64
 	ID() int64
 	CurrentBlock() uint64
@@ -23,6 +33,15 @@ type State interface {
 	RandomCall() (to, from, input string, block uint64)
 }
 
+// anchoredState is implemented by states that anchor every query at its own
+// height. The anchor is drawn before the query is generated, so the whole
+// query sees the same CurrentBlock, and anchorTag replaces the tags of queries
+// of the current chain state.
+type anchoredState interface {
+	drawAnchor()
+	anchorTag() string
+}
+
 type IdGenerator struct {
 	id int64
 }
@@ -36,10 +55,31 @@ func (gen *IdGenerator) Next() int64 {
 type LiveState struct {
 	IdGen   *IdGenerator
 	RandSrc rand.Source
+	// OrphanedShare is the fraction of block and transaction hashes to pick
+	// from reorged-out blocks, to exercise "not found" paths
+	OrphanedShare float64
 
 	currentBlock uint64
 	transactions []eth.Transaction
 	blockHashes  map[uint64]string
+	blocks       []uint64   // sorted keys of blockHashes, for deterministic sampling
+	contracts    []Contract // discovered
+	known        []Contract // configured for the network
+	activity     activityTable
+
+	reorgs         int64
+	orphanedBlocks []string
+	orphanedTxs    []string
+}
+
+func (s *LiveState) Fork(randSrc rand.Source) State {
+	return s.fork(randSrc)
+}
+
+func (s *LiveState) fork(randSrc rand.Source) *LiveState {
+	fork := *s
+	fork.RandSrc = randSrc
+	return &fork
 }
 
 func (s *LiveState) ID() int64 {
@@ -50,11 +90,37 @@ func (s *LiveState) CurrentBlock() uint64 {
 	return s.currentBlock
 }
 
+// Size returns the number of transactions and block hashes the state samples
+// from.
+func (s *LiveState) Size() (transactions, blockHashes int) {
+	return len(s.transactions), len(s.blockHashes)
+}
+
+// Reorgs returns the number of chain reorganizations seen by the state.
+func (s *LiveState) Reorgs() int64 {
+	return s.reorgs
+}
+
 func (s *LiveState) RandInt64() int64 {
 	return s.RandSrc.Int63()
 }
 
+// pickOrphaned returns a random hash from the orphaned pool for the configured
+// share of calls, or "" otherwise.
+func (s *LiveState) pickOrphaned(pool []string) string {
+	if s.OrphanedShare <= 0 || len(pool) == 0 {
+		return ""
+	}
+	if float64(s.RandSrc.Int63()%1000) >= s.OrphanedShare*1000 {
+		return ""
+	}
+	return pool[int(s.RandSrc.Int63())%len(pool)]
+}
+
 func (s *LiveState) RandomTransaction() string {
+	if hash := s.pickOrphaned(s.orphanedTxs); hash != "" {
+		return hash
+	}
 	if len(s.transactions) == 0 {
 		return ""
 	}
@@ -85,30 +151,43 @@ func (s *LiveState) RandomCall() (to, from, input string, block uint64) {
 }
 
 func (s *LiveState) RandomContract() (addr string, topics []string) {
-	// TODO: Scrape https://etherscan.io/accounts or https://ethgasstation.info/gasguzzlers.php instead?
-	idx := s.RandInt64() % int64(len(popularContracts))
-	c := popularContracts[idx]
+	contracts := s.Contracts()
+	idx := s.RandInt64() % int64(len(contracts))
+	c := contracts[idx]
 	return c.Addr, c.Topics
 }
 
+// Contracts returns the contracts RandomContract picks from: the most active
+// ones in recent receipts, or until some are seen, the ones configured for the
+// network, falling back to popular mainnet contracts.
+func (s *LiveState) Contracts() []Contract {
+	if len(s.contracts) > 0 {
+		return s.contracts
+	}
+	if len(s.known) > 0 {
+		return s.known
+	}
+	return popularContracts
+}
+
 func (s *LiveState) RandomBlock() string {
-	if len(s.blockHashes) == 0 {
-		return ""
+	if hash := s.pickOrphaned(s.orphanedBlocks); hash != "" {
+		return hash
 	}
-	idx := int(s.RandSrc.Int63()) % len(s.blockHashes)
-	for _, value := range s.blockHashes {
-		if idx == 0 {
-			return value
-		}
-		idx--
+	if len(s.blocks) == 0 {
+		return ""
 	}
-	return ""
+	idx := int(s.RandSrc.Int63()) % len(s.blocks)
+	return s.blockHashes[s.blocks[idx]]
 }
 
-var popularContracts = []struct {
-	Addr   string
-	Topics []string
-}{
+// Contract is an address with the log topics it is known to emit.
+type Contract struct {
+	Addr   string   `json:"address"`
+	Topics []string `json:"topics"`
+}
+
+var popularContracts = []Contract{
 	{
 		"0xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2", // Wrapped ETH (wETH)
 		[]string{"0x7fcf532c15f0a6db0bd6d0e038bea71d30d808c7d98cb3bf7268a95bf5081b65", "0x00000000000000000000000076481caa104b5f6bccb540dae4cefaf1c398ebea"},
@@ -137,8 +216,31 @@ var popularContracts = []struct {
 
 type StateProducer struct {
 	Client node.Client
+	// TxPoolSize is the number of transactions to keep, DefaultTxPoolSize if zero
+	TxPoolSize int
+	// OrphanedShare is passed on to the states produced
+	OrphanedShare float64
+	// ReceiptSamples is the number of receipts fetched per new block to
+	// discover active contracts, DefaultReceiptSamples if zero and none if
+	// negative
+	ReceiptSamples int
+	// Contracts are sampled until active ones are discovered, such as the
+	// list for the network from NetworkContracts
+	Contracts []Contract
 }
 
+// Limits on how much history the state keeps
+const (
+	// maxCatchUp is the most missed blocks fetched by a single Refresh
+	maxCatchUp = 16
+	// blockHashWindow is how many blocks behind the current one are kept
+	blockHashWindow = 256
+	// maxReorgDepth is the most blocks walked back to find a common ancestor
+	maxReorgDepth = 64
+	// maxOrphaned is how many reorged-out block and transaction hashes are kept
+	maxOrphaned = 64
+)
+
 func (p *StateProducer) Refresh(oldState *LiveState) (*LiveState, error) {
 	if oldState == nil {
 		return nil, errors.New("must provide old state to refresh")
@@ -148,43 +250,178 @@ func (p *StateProducer) Refresh(oldState *LiveState) (*LiveState, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Polls at the block time often see the same head again, which would
+	// only add its transactions and receipts to the state a second time
+	if b.Number.UInt64() == oldState.currentBlock && b.Hash.String() == oldState.blockHashes[oldState.currentBlock] {
+		return nil, ErrSameHead
+	}
 	// Short circuit if the sampled block is empty
 	if len(b.Transactions) == 0 {
 		return nil, ErrEmptyBlock
 	}
 
+	// Fetch the blocks we missed since the old state so every block is tracked
+	blocks := []*eth.Block{}
+	latest := b.Number.UInt64()
+	if prev := oldState.currentBlock; prev != 0 && latest > prev+1 {
+		from := prev + 1
+		if latest-from > maxCatchUp {
+			from = latest - maxCatchUp
+		}
+		for n := from; n < latest; n++ {
+			missed, err := p.Client.BlockByNumber(context.Background(), n, true)
+			if err != nil {
+				return nil, err
+			}
+			blocks = append(blocks, missed)
+		}
+	}
+	blocks = append(blocks, b)
+
+	// Walk back until the oldest new block builds on a block we know, every
+	// stored block it doesn't build on was reorged out
+	for depth := 0; depth < maxReorgDepth; depth++ {
+		first := blocks[0]
+		stored, ok := oldState.blockHashes[first.Number.UInt64()-1]
+		if !ok || stored == first.ParentHash.String() {
+			break
+		}
+		parent, err := p.Client.BlockByHash(context.Background(), first.ParentHash.String(), true)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append([]*eth.Block{parent}, blocks...)
+	}
+
+	canonical := make(map[uint64]string, len(blocks)+1)
+	for _, b := range blocks {
+		canonical[b.Number.UInt64()] = b.Hash.String()
+		canonical[b.Number.UInt64()-1] = b.ParentHash.String()
+	}
+	orphaned := map[string]bool{}
+	for n, hash := range oldState.blockHashes {
+		if c, ok := canonical[n]; (ok && c != hash) || n > latest {
+			orphaned[hash] = true
+		}
+	}
+
 	blockHashes := make(map[uint64]string)
 	for k, v := range oldState.blockHashes {
-		blockHashes[k] = v
+		if k+blockHashWindow >= latest && !orphaned[v] {
+			blockHashes[k] = v
+		}
 	}
 
-	blockHashes[b.Number.UInt64()] = b.Hash.String()
-	blockHashes[b.Number.UInt64()-1] = b.ParentHash.String()
+	poolSize := p.TxPoolSize
+	if poolSize == 0 {
+		poolSize = DefaultTxPoolSize
+	}
 
+	// Copy, the old state may still be in use
+	txs := make([]eth.Transaction, 0, len(oldState.transactions))
+	orphanedTxs := oldState.orphanedTxs
+	for _, tx := range oldState.transactions {
+		if tx.BlockHash != nil && orphaned[tx.BlockHash.String()] {
+			orphanedTxs = append(orphanedTxs, tx.Hash.String())
+			continue
+		}
+		txs = append(txs, tx)
+	}
+	samples := p.ReceiptSamples
+	if samples == 0 {
+		samples = DefaultReceiptSamples
+	}
+	activity := oldState.activity.decayed()
+	for _, b := range blocks {
+		blockHashes[b.Number.UInt64()] = b.Hash.String()
+		blockHashes[b.Number.UInt64()-1] = b.ParentHash.String()
+		txs = mergeTransactions(txs, b, poolSize)
+	}
+	if samples > 0 {
+		observeReceipts(p.Client, activity, blocks, samples)
+	}
+	activity = activity.trimmed(maxTrackedContracts)
+	contracts := oldState.contracts
+	if discovered := activity.ranked(maxContracts); len(discovered) > 0 {
+		contracts = discovered
+	}
+
+	reorgs := oldState.reorgs
+	orphanedBlocks := oldState.orphanedBlocks
+	if len(orphaned) > 0 {
+		reorgs++
+		for _, n := range sortedBlocks(oldState.blockHashes) {
+			if hash := oldState.blockHashes[n]; orphaned[hash] {
+				orphanedBlocks = append(orphanedBlocks, hash)
+			}
+		}
+	}
+
+	state := LiveState{
+		IdGen:         oldState.IdGen,
+		RandSrc:       oldState.RandSrc,
+		OrphanedShare: p.OrphanedShare,
+
+		currentBlock: latest,
+		transactions: txs,
+		blockHashes:  blockHashes,
+		blocks:       sortedBlocks(blockHashes),
+		contracts:    contracts,
+		known:        p.Contracts,
+		activity:     activity,
+
+		reorgs:         reorgs,
+		orphanedBlocks: lastHashes(orphanedBlocks, maxOrphaned),
+		orphanedTxs:    lastHashes(orphanedTxs, maxOrphaned),
+	}
+	return &state, nil
+}
+
+// lastHashes returns a copy of at most the n most recent hashes.
+func lastHashes(hashes []string, n int) []string {
+	if len(hashes) > n {
+		hashes = hashes[len(hashes)-n:]
+	}
+	return append([]string(nil), hashes...)
+}
+
+// mergeTransactions adds the contract calls of the block to the pool.
+func mergeTransactions(txs []eth.Transaction, b *eth.Block, poolSize int) []eth.Transaction {
 	// txs will grow to the maximum contract transaction list size we'll see in a block, and the higher-indexed ones will stick around longer
-	txs := oldState.transactions
+	prevSize := len(txs)
 	for i, tx := range b.Transactions {
 		if tx.Transaction.Value.Int64() > 0 {
 			// Only take 0-value transactions, hopefully these are all contract calls.
 			continue
 		}
-		if len(oldState.transactions) < 50 || i > len(txs) {
+		if prevSize < poolSize || i >= len(txs) {
 			txs = append(txs, tx.Transaction)
 			continue
 		}
-		// Keep some old transactions randomly
-		if oldState.RandInt64()%6 > 2 {
+		// Keep some old transactions randomly. The hash stands in for the
+		// random source, which belongs to the generator using the old state.
+		if hashByte(tx.Transaction.Hash)%6 > 2 {
 			txs[i] = tx.Transaction
 		}
 	}
+	return txs
+}
 
-	state := LiveState{
-		IdGen:   oldState.IdGen,
-		RandSrc: oldState.RandSrc,
+// hashByte returns the last byte of the hash.
+func hashByte(h eth.Hash) uint64 {
+	s := h.String()
+	if len(s) < 2 {
+		return 0
+	}
+	b, _ := strconv.ParseUint(s[len(s)-2:], 16, 8)
+	return b
+}
 
-		currentBlock: b.Number.UInt64(),
-		transactions: txs,
-		blockHashes:  blockHashes,
+func sortedBlocks(blockHashes map[uint64]string) []uint64 {
+	blocks := make([]uint64, 0, len(blockHashes))
+	for n := range blockHashes {
+		blocks = append(blocks, n)
 	}
-	return &state, nil
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i] < blocks[j] })
+	return blocks
 }
@@ -0,0 +1,191 @@
+package ethspam
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/INFURA/go-ethlibs/eth"
+	"github.com/INFURA/go-ethlibs/node"
+)
+
+// fakeChain is a node.Client serving the blocks of a single chain, with one
+// contract call in each block.
+type fakeChain struct {
+	node.Client
+	tip      uint64
+	byNumber map[uint64]*eth.Block
+	byHash   map[string]*eth.Block
+}
+
+// newFakeChain returns blocks 1 to tip, which are on the "a" branch up to
+// forkAt and on the given branch after it.
+func newFakeChain(tip, forkAt uint64, branch string) *fakeChain {
+	c := &fakeChain{tip: tip, byNumber: map[uint64]*eth.Block{}, byHash: map[string]*eth.Block{}}
+	for n := uint64(1); n <= tip; n++ {
+		parent, hash := chainBlockHash("a", n-1), chainBlockHash("a", n)
+		if n > forkAt {
+			hash = chainBlockHash(branch, n)
+			if n-1 > forkAt {
+				parent = chainBlockHash(branch, n-1)
+			}
+		}
+		b := chainBlock(n, hash, parent)
+		c.byNumber[n] = b
+		c.byHash[hash] = b
+	}
+	return c
+}
+
+func chainBlockHash(branch string, n uint64) string {
+	return fmt.Sprintf("0x%s%063x", branch, n)
+}
+
+// chainTxHash returns the hash of the transaction of a block, which also
+// differs by branch.
+func chainTxHash(blockHash string) string {
+	return "0xf" + blockHash[2:]
+}
+
+func chainBlock(n uint64, hash, parent string) *eth.Block {
+	number := eth.QuantityFromUInt64(n)
+	blockHash := eth.Hash(hash)
+	return &eth.Block{
+		Number:     &number,
+		Hash:       &blockHash,
+		ParentHash: eth.Hash(parent),
+		Transactions: []eth.TxOrHash{{
+			Transaction: eth.Transaction{
+				Hash:        eth.Hash(chainTxHash(hash)),
+				BlockHash:   &blockHash,
+				BlockNumber: &number,
+			},
+			Populated: true,
+		}},
+	}
+}
+
+// state returns the LiveState of a refresh at every block of the chain.
+func (c *fakeChain) state() *LiveState {
+	s := &LiveState{currentBlock: c.tip, blockHashes: map[uint64]string{}}
+	for n := uint64(1); n <= c.tip; n++ {
+		b := c.byNumber[n]
+		s.blockHashes[n] = b.Hash.String()
+		s.blockHashes[n-1] = b.ParentHash.String()
+		s.transactions = append(s.transactions, b.Transactions[0].Transaction)
+	}
+	s.blocks = sortedBlocks(s.blockHashes)
+	return s
+}
+
+func (c *fakeChain) BlockByNumberOrTag(ctx context.Context, numOrTag eth.BlockNumberOrTag, full bool) (*eth.Block, error) {
+	return c.byNumber[c.tip], nil
+}
+
+func (c *fakeChain) BlockByNumber(ctx context.Context, number uint64, full bool) (*eth.Block, error) {
+	if b, ok := c.byNumber[number]; ok {
+		return b, nil
+	}
+	return nil, errors.New("block not found")
+}
+
+func (c *fakeChain) BlockByHash(ctx context.Context, hash string, full bool) (*eth.Block, error) {
+	if b, ok := c.byHash[hash]; ok {
+		return b, nil
+	}
+	return nil, errors.New("block not found")
+}
+
+func TestRefreshReorg(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      *fakeChain
+		new      *fakeChain
+		reorgs   int64
+		orphaned []uint64 // blocks of the old chain
+	}{
+		{
+			name: "no reorg",
+			old:  newFakeChain(10, 10, "a"),
+			new:  newFakeChain(12, 12, "a"),
+		},
+		{
+			name:     "one block",
+			old:      newFakeChain(10, 10, "a"),
+			new:      newFakeChain(11, 9, "b"),
+			reorgs:   1,
+			orphaned: []uint64{10},
+		},
+		{
+			name:     "several blocks",
+			old:      newFakeChain(10, 10, "a"),
+			new:      newFakeChain(12, 7, "b"),
+			reorgs:   1,
+			orphaned: []uint64{8, 9, 10},
+		},
+		{
+			name:     "shorter chain",
+			old:      newFakeChain(10, 10, "a"),
+			new:      newFakeChain(9, 8, "b"),
+			reorgs:   1,
+			orphaned: []uint64{9, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := StateProducer{Client: tt.new, ReceiptSamples: -1}
+			state, err := p.Refresh(tt.old.state())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if state.currentBlock != tt.new.tip {
+				t.Errorf("current block: got %d, want %d", state.currentBlock, tt.new.tip)
+			}
+			for n := uint64(1); n <= tt.new.tip; n++ {
+				if got, want := state.blockHashes[n], tt.new.byNumber[n].Hash.String(); got != want {
+					t.Errorf("hash of block %d: got %s, want %s", n, got, want)
+				}
+			}
+			for n := range state.blockHashes {
+				if n > tt.new.tip {
+					t.Errorf("block %d above the tip is kept", n)
+				}
+			}
+			if state.reorgs != tt.reorgs {
+				t.Errorf("reorgs: got %d, want %d", state.reorgs, tt.reorgs)
+			}
+
+			var orphanedBlocks, orphanedTxs []string
+			for _, n := range tt.orphaned {
+				hash := tt.old.byNumber[n].Hash.String()
+				orphanedBlocks = append(orphanedBlocks, hash)
+				orphanedTxs = append(orphanedTxs, chainTxHash(hash))
+			}
+			if !reflect.DeepEqual(state.orphanedBlocks, orphanedBlocks) {
+				t.Errorf("orphaned blocks: got %v, want %v", state.orphanedBlocks, orphanedBlocks)
+			}
+			// Transactions follow the order of the old pool, which is by block
+			if !reflect.DeepEqual(state.orphanedTxs, orphanedTxs) {
+				t.Errorf("orphaned transactions: got %v, want %v", state.orphanedTxs, orphanedTxs)
+			}
+			for _, tx := range state.transactions {
+				for _, hash := range orphanedTxs {
+					if tx.Hash.String() == hash {
+						t.Errorf("orphaned transaction %s is still sampled", hash)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshSameHead(t *testing.T) {
+	chain := newFakeChain(10, 10, "a")
+	p := StateProducer{Client: chain, ReceiptSamples: -1}
+	if _, err := p.Refresh(chain.state()); err != ErrSameHead {
+		t.Errorf("got %v, want ErrSameHead", err)
+	}
+}
@@ -0,0 +1,256 @@
+package ethspam
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// Buckets per doubling of latency, for a relative error of about 4%
+	histogramResolution = 16
+	// Enough doublings to cover 1µs to ~18 minutes
+	histogramBuckets = 30 * histogramResolution
+)
+
+// Histogram is a log-linear latency histogram with a fixed memory footprint.
+// Not goroutine-safe on its own, Stats guards it.
+type Histogram struct {
+	counts [histogramBuckets]int64
+	total  int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+func histogramBucket(d time.Duration) int {
+	us := float64(d) / float64(time.Microsecond)
+	if us <= 1 {
+		return 0
+	}
+	idx := int(math.Log2(us) * histogramResolution)
+	if idx >= histogramBuckets {
+		return histogramBuckets - 1
+	}
+	return idx
+}
+
+// histogramUpperBound returns the largest latency counted in the bucket.
+func histogramUpperBound(idx int) time.Duration {
+	return time.Duration(math.Exp2(float64(idx+1)/histogramResolution) * float64(time.Microsecond))
+}
+
+// Observe records a single latency.
+func (h *Histogram) Observe(d time.Duration) {
+	h.counts[histogramBucket(d)]++
+	h.total++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *Histogram) merge(other *Histogram) {
+	for idx, count := range other.counts {
+		h.counts[idx] += count
+	}
+	h.total += other.total
+	h.sum += other.sum
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Count returns the number of observed latencies.
+func (h *Histogram) Count() int64 {
+	return h.total
+}
+
+// Quantile returns an upper bound of the latency at quantile q (0 < q <= 1).
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.total)))
+	var current int64
+	for idx, count := range h.counts {
+		current += count
+		if current >= rank {
+			if bound := histogramUpperBound(idx); bound < h.max {
+				return bound
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// MethodStats summarizes the sent queries of a single method.
+type MethodStats struct {
+	Method  string
+	Errors  int64
+	Latency Histogram
+
+	// ErrorCodes counts errors by the code returned from ErrorCode
+	ErrorCodes map[string]int64
+
+	// le counts latencies up to each of the metricsBuckets bounds, exactly
+	// rather than from the log buckets of Latency
+	le []int64
+}
+
+// EventStats counts occurrences of something that isn't a timed query, such
+// as a subscription notification or a dropped connection.
+type EventStats struct {
+	Name   string
+	Count  int64
+	Errors int64
+
+	// ErrorCodes counts errors by the code returned from ErrorCode
+	ErrorCodes map[string]int64
+}
+
+// Stats collects per-method results of sent queries, and counts of other
+// events. Goroutine-safe.
+type Stats struct {
+	mu      sync.Mutex
+	started time.Time
+	methods map[string]*MethodStats
+	events  map[string]*EventStats
+}
+
+// NewStats returns an empty Stats with the throughput clock started.
+func NewStats() *Stats {
+	return &Stats{
+		started: time.Now(),
+		methods: map[string]*MethodStats{},
+		events:  map[string]*EventStats{},
+	}
+}
+
+// Record adds the result of a single query, keyed by the generating method.
+func (s *Stats) Record(method string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, ok := s.methods[method]
+	if !ok {
+		m = &MethodStats{
+			Method:     method,
+			ErrorCodes: map[string]int64{},
+			le:         make([]int64, len(metricsBuckets)),
+		}
+		s.methods[method] = m
+	}
+	m.Latency.Observe(latency)
+	for i, bound := range metricsBuckets {
+		if latency <= bound {
+			m.le[i]++
+		}
+	}
+	if err != nil {
+		m.Errors++
+		m.ErrorCodes[ErrorCode(err)]++
+	}
+}
+
+// Count adds an event without a latency. Events are kept out of the latency
+// histograms and the total of WriteTable.
+func (s *Stats) Count(name string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.events[name]
+	if !ok {
+		e = &EventStats{Name: name, ErrorCodes: map[string]int64{}}
+		s.events[name] = e
+	}
+	e.Count++
+	if err != nil {
+		e.Errors++
+		e.ErrorCodes[ErrorCode(err)]++
+	}
+}
+
+// ErrorCode classifies an error recorded while sending: the JSONRPC error code,
+// http_<status> for unexpected HTTP responses, timeout for requests that
+// timed out on either transport, or "other".
+func ErrorCode(err error) string {
+	if err == errTimeout {
+		return "timeout"
+	}
+	switch err := err.(type) {
+	case *RPCError:
+		return strconv.Itoa(err.Code)
+	case *StatusError:
+		return "http_" + strconv.Itoa(err.StatusCode)
+	case net.Error:
+		if err.Timeout() {
+			return "timeout"
+		}
+	}
+	return "other"
+}
+
+// WriteTable writes a summary table of all methods seen so far, sorted by
+// request count, followed by the counted events.
+func (s *Stats) WriteTable(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.started).Seconds()
+	methods := make([]*MethodStats, 0, len(s.methods))
+	var total MethodStats
+	total.Method = "total"
+	for _, m := range s.methods {
+		methods = append(methods, m)
+		total.Errors += m.Errors
+		total.Latency.merge(&m.Latency)
+	}
+	sort.Slice(methods, func(i, j int) bool {
+		if methods[i].Latency.total != methods[j].Latency.total {
+			return methods[i].Latency.total > methods[j].Latency.total
+		}
+		return methods[i].Method < methods[j].Method
+	})
+	methods = append(methods, &total)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "method\trequests\terrors\treq/s\tp50\tp90\tp99\tp999\t")
+	for _, m := range methods {
+		h := &m.Latency
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n",
+			m.Method, h.total, m.Errors, float64(h.total)/elapsed,
+			roundLatency(h.Quantile(0.5)), roundLatency(h.Quantile(0.9)),
+			roundLatency(h.Quantile(0.99)), roundLatency(h.Quantile(0.999)),
+		)
+	}
+	for _, name := range sortedEvents(s.events) {
+		e := s.events[name]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t-\t-\t-\t-\t\n",
+			e.Name, e.Count, e.Errors, float64(e.Count)/elapsed,
+		)
+	}
+	return tw.Flush()
+}
+
+func sortedEvents(events map[string]*EventStats) []string {
+	names := make([]string, 0, len(events))
+	for name := range events {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func roundLatency(d time.Duration) time.Duration {
+	if d > time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
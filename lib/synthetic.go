@@ -0,0 +1,154 @@
+package ethspam
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Defaults for the chain fabricated by a SyntheticState
+const (
+	DefaultSyntheticHeight    = 20000000
+	DefaultSyntheticBlockTime = 12 * time.Second
+)
+
+// Sizes of the fabricated account, contract and selector pools
+const (
+	syntheticAccounts   = 1000
+	syntheticContracts  = 50
+	syntheticTxPerBlock = 100
+)
+
+// Common function selectors, so calldata looks like real contract calls
+var syntheticSelectors = []string{
+	"a9059cbb", // transfer(address,uint256)
+	"095ea7b3", // approve(address,uint256)
+	"23b872dd", // transferFrom(address,address,uint256)
+	"70a08231", // balanceOf(address)
+	"dd62ed3e", // allowance(address,address)
+	"38ed1739", // swapExactTokensForTokens(...)
+}
+
+// SyntheticState implements State without any network access. Block numbers,
+// hashes, addresses, calldata and topics are fabricated from the seed, so two
+// states with the same seed describe the same chain. The chain grows by a
+// block every BlockTime, or stays at Height if BlockTime is zero, which makes
+// the query stream fully deterministic for a given RandSrc.
+type SyntheticState struct {
+	IdGen   *IdGenerator
+	RandSrc rand.Source
+
+	Seed      int64
+	Height    uint64
+	BlockTime time.Duration
+
+	start     time.Time
+	accounts  []string
+	contracts []Contract
+}
+
+// NewSyntheticState returns a SyntheticState for a chain at the given height
+// growing every blockTime.
+func NewSyntheticState(seed int64, height uint64, blockTime time.Duration) *SyntheticState {
+	s := &SyntheticState{
+		IdGen:     &IdGenerator{},
+		RandSrc:   rand.NewSource(seed),
+		Seed:      seed,
+		Height:    height,
+		BlockTime: blockTime,
+		start:     time.Now(),
+	}
+	for i := 0; i < syntheticAccounts; i++ {
+		s.accounts = append(s.accounts, s.fabricate(20, "account", uint64(i)))
+	}
+	for i := 0; i < syntheticContracts; i++ {
+		c := Contract{Addr: s.fabricate(20, "contract", uint64(i))}
+		for t := uint64(0); t < uint64(i%4); t++ {
+			c.Topics = append(c.Topics, s.fabricate(32, "topic", uint64(i)<<8|t))
+		}
+		s.contracts = append(s.contracts, c)
+	}
+	return s
+}
+
+func (s *SyntheticState) Fork(randSrc rand.Source) State {
+	fork := *s
+	fork.RandSrc = randSrc
+	return &fork
+}
+
+func (s *SyntheticState) ID() int64 {
+	return s.IdGen.Next()
+}
+
+func (s *SyntheticState) RandInt64() int64 {
+	return s.RandSrc.Int63()
+}
+
+func (s *SyntheticState) CurrentBlock() uint64 {
+	if s.BlockTime <= 0 {
+		return s.Height
+	}
+	return s.Height + uint64(time.Since(s.start)/s.BlockTime)
+}
+
+func (s *SyntheticState) RandomContract() (addr string, topics []string) {
+	c := s.contracts[s.RandInt64()%int64(len(s.contracts))]
+	return c.Addr, c.Topics
+}
+
+func (s *SyntheticState) RandomAddress() string {
+	return s.accounts[s.RandInt64()%int64(len(s.accounts))]
+}
+
+func (s *SyntheticState) RandomTransaction() string {
+	block := s.recentBlock()
+	index := uint64(s.RandInt64() % syntheticTxPerBlock)
+	return s.fabricate(32, "transaction", block<<16|index)
+}
+
+func (s *SyntheticState) RandomBlock() string {
+	return s.fabricate(32, "block", s.recentBlock())
+}
+
+func (s *SyntheticState) RandomCall() (to, from, input string, block uint64) {
+	to, _ = s.RandomContract()
+	from = s.RandomAddress()
+	selector := syntheticSelectors[s.RandInt64()%int64(len(syntheticSelectors))]
+	// A single address argument, left-padded to 32 bytes
+	input = "0x" + selector + "000000000000000000000000" + s.RandomAddress()[2:]
+	block = s.recentBlock()
+	return
+}
+
+// recentBlock returns a block within the hash window behind the current one.
+func (s *SyntheticState) recentBlock() uint64 {
+	return behind(s.CurrentBlock(), uint64(s.RandInt64()%blockHashWindow))
+}
+
+// fabricate returns a hex string of size bytes derived from the seed, the kind
+// of value and its index.
+func (s *SyntheticState) fabricate(size int, kind string, index uint64) string {
+	x := uint64(s.Seed) ^ index
+	for _, c := range kind {
+		x = splitmix64(x ^ uint64(c))
+	}
+	var arr [2 + 64]byte
+	buf := append(arr[:0], "0x"...)
+	for len(buf) < 2+size*2 {
+		x = splitmix64(x)
+		for shift := 60; shift >= 0 && len(buf) < 2+size*2; shift -= 4 {
+			buf = append(buf, hexDigits[x>>uint(shift)&0xf])
+		}
+	}
+	return string(buf)
+}
+
+const hexDigits = "0123456789abcdef"
+
+// splitmix64 is a fast, well distributed 64-bit mixing function.
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
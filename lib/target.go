@@ -0,0 +1,129 @@
+package ethspam
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RPCError is a JSONRPC error object returned by the endpoint.
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("jsonrpc error %d: %s", e.Code, e.Message)
+}
+
+// StatusError is returned for HTTP responses other than 200 OK.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "unexpected response status: " + e.Status
+}
+
+// Target sends generated queries to a JSONRPC endpoint over HTTP, reusing
+// keep-alive connections between requests.
+type Target struct {
+	Endpoint string
+	Client   *http.Client
+
+	// bodies are the buffers requests are rendered into, see requestBody
+	bodies sync.Pool
+}
+
+// NewTarget returns a Target with an idle connection pool sized for the given
+// number of concurrent senders. The timeout applies to each request.
+func NewTarget(endpoint string, concurrency int, timeout time.Duration) *Target {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        concurrency,
+		MaxIdleConnsPerHost: concurrency,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &Target{
+		Endpoint: endpoint,
+		Client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+	}
+}
+
+// Send posts the query to the endpoint and returns the raw response body. A
+// response carrying a JSONRPC error is returned along with an *RPCError.
+func (t *Target) Send(ctx context.Context, q QueryContent) ([]byte, error) {
+	reqBody := t.requestBody(q)
+	req, err := http.NewRequest(http.MethodPost, t.Endpoint, reqBody)
+	if err != nil {
+		reqBody.Close()
+		return nil, err
+	}
+	req.ContentLength = int64(reqBody.Len())
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// The body must be drained for the connection to be reused
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return body, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	var reply struct {
+		Error *RPCError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return body, fmt.Errorf("failed to decode response: %s", err)
+	}
+	if reply.Error != nil {
+		return body, reply.Error
+	}
+	return body, nil
+}
+
+// requestBody is a query rendered into a pooled buffer. The transport may
+// still be writing the body after the response is in, so the buffer only goes
+// back to the pool once the transport closes the body.
+type requestBody struct {
+	bytes.Reader
+	pool   *sync.Pool
+	buf    *[]byte
+	closed int32
+}
+
+func (t *Target) requestBody(q QueryContent) *requestBody {
+	buf, _ := t.bodies.Get().(*[]byte)
+	if buf == nil {
+		buf = new([]byte)
+	}
+	*buf = q.AppendBody((*buf)[:0])
+	body := &requestBody{pool: &t.bodies, buf: buf}
+	body.Reset(*buf)
+	return body
+}
+
+func (b *requestBody) Close() error {
+	if atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		b.pool.Put(b.buf)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package ethspam
+
+import (
+	"strconv"
+	"strings"
+)
+
+// traceFilterCount is the page size of trace_filter queries, as clients
+// paginate through heavy filters
+const traceFilterCount = 100
+
+// traceTypes are the trace types of the trace_call and trace_replay* methods
+var traceTypes = map[string]bool{
+	"trace":     true,
+	"vmTrace":   true,
+	"stateDiff": true,
+}
+
+// traceTypeCombos returns the trace type combinations of the method profile
+// as JSON arrays, weighted.
+func traceTypeCombos(p MethodProfile) weightedParams {
+	var combos weightedParams
+	for _, set := range p.TraceTypes {
+		combos.add(`["`+strings.Join(set.Types, `","`)+`"]`, set.Weight)
+	}
+	return combos
+}
+
+func getTraceBlock(s State) QueryContent {
+	return QueryContent{
+		Id:     s.ID(),
+		Method: "trace_block",
+		Params: stringParams(blockTag(s, "latest")),
+	}
+}
+
+func getTraceTransaction(s State) QueryContent {
+	hash := s.RandomTransaction()
+	return QueryContent{
+		Id:     s.ID(),
+		Method: "trace_transaction",
+		Params: stringParams(hash),
+	}
+}
+
+func getTraceGet(s State) QueryContent {
+	hash := s.RandomTransaction()
+	// Most transactions have a few internal calls at most
+	var buf [128]byte
+	b := append(buf[:0], '[')
+	b = appendString(b, hash)
+	b = append(b, ',', '[')
+	b = appendQuantity(b, uint64(s.RandInt64()%3))
+	b = append(b, ']', ']')
+	return QueryContent{
+		Id:     s.ID(),
+		Method: "trace_get",
+		Params: string(b),
+	}
+}
+
+func genTraceFilter(p MethodProfile) Generator {
+	return func(s State) QueryContent {
+		to := behind(s.CurrentBlock(), uint64(s.RandInt64())%p.Recency)
+		from := behind(to, paretoRange(s, p.RangeAlpha, p.BlockRange)-1)
+
+		var buf [256]byte
+		b := append(buf[:0], `[{"fromBlock":`...)
+		b = appendQuantity(b, from)
+		b = append(b, `,"toBlock":`...)
+		b = appendQuantity(b, to)
+		// Traces of an account's transactions, or of the calls into a contract
+		if s.RandInt64()%2 == 0 {
+			b = append(b, `,"fromAddress":[`...)
+			b = appendString(b, s.RandomAddress())
+		} else {
+			addr, _ := s.RandomContract()
+			b = append(b, `,"toAddress":[`...)
+			b = appendString(b, addr)
+		}
+		b = append(b, `],"count":`...)
+		b = strconv.AppendInt(b, traceFilterCount, 10)
+		b = append(b, '}', ']')
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "trace_filter",
+			Params: string(b),
+		}
+	}
+}
+
+func genTraceCall(p MethodProfile) Generator {
+	combos := traceTypeCombos(p)
+	return func(s State) QueryContent {
+		to, from, input, block := s.RandomCall()
+		var buf [512]byte
+		b := append(buf[:0], '[')
+		b = appendCall(b, to, from, input)
+		b = append(b, ',')
+		b = append(b, combos.pick(s)...)
+		b = append(b, ',')
+		b = appendQuantity(b, block-1)
+		b = append(b, ']')
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "trace_call",
+			Params: string(b),
+		}
+	}
+}
+
+func genTraceCallMany(p MethodProfile) Generator {
+	combos := traceTypeCombos(p)
+	return func(s State) QueryContent {
+		// A few calls in sequence on top of the block of the first
+		n := 2 + int(s.RandInt64()%4)
+		var buf [2048]byte
+		b := append(buf[:0], '[', '[')
+		var first uint64
+		for i := 0; i < n; i++ {
+			to, from, input, block := s.RandomCall()
+			if i == 0 {
+				first = block
+			} else {
+				b = append(b, ',')
+			}
+			b = append(b, '[')
+			b = appendCall(b, to, from, input)
+			b = append(b, ',')
+			b = append(b, combos.pick(s)...)
+			b = append(b, ']')
+		}
+		b = append(b, ']', ',')
+		b = appendQuantity(b, first-1)
+		b = append(b, ']')
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "trace_callMany",
+			Params: string(b),
+		}
+	}
+}
+
+func genTraceReplayTransaction(p MethodProfile) Generator {
+	combos := traceTypeCombos(p)
+	return func(s State) QueryContent {
+		hash := s.RandomTransaction()
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "trace_replayTransaction",
+			Params: `["` + hash + `",` + combos.pick(s) + `]`,
+		}
+	}
+}
+
+func genTraceReplayBlockTransactions(p MethodProfile) Generator {
+	combos := traceTypeCombos(p)
+	return func(s State) QueryContent {
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "trace_replayBlockTransactions",
+			Params: `["` + blockTag(s, "latest") + `",` + combos.pick(s) + `]`,
+		}
+	}
+}
+
+// TraceRawTransaction returns a trace_rawTransaction generator of the signed
+// transactions from raw, such as Wallet.RawTransaction, with the trace types
+// of the method profile.
+func TraceRawTransaction(raw func(State) string, p MethodProfile) Generator {
+	combos := traceTypeCombos(p.withDefaults())
+	return func(s State) QueryContent {
+		tx := raw(s)
+		return QueryContent{
+			Id:     s.ID(),
+			Method: "trace_rawTransaction",
+			Params: `["` + tx + `",` + combos.pick(s) + `]`,
+		}
+	}
+}
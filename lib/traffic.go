@@ -0,0 +1,126 @@
+package ethspam
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+// Longest log line we expect, some request bodies are large
+const maxLogLine = 16 * 1024 * 1024
+
+type loggedRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// ProfileFromLog derives method weights from recorded JSONRPC traffic. The log
+// has one request or batch per line, either as plain JSON or embedded in a
+// line like an nginx access log entry with the request body. Filter methods
+// count towards the filters sessions. Methods without a generator are
+// returned separately with their counts.
+func ProfileFromLog(r io.Reader) (profile Profile, unsupported map[string]int64, err error) {
+	counts := map[string]int64{}
+	unsupported = map[string]int64{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		for _, req := range parseLogLine(scanner.Bytes()) {
+			if req.Method == "" {
+				continue
+			}
+			method := req.Method + methodVariant(req)
+			if filterMethods[req.Method] {
+				// The whole lifecycle is weighted as one
+				method = "filters"
+			}
+			if IsSupported(method) {
+				counts[method]++
+			} else {
+				unsupported[method]++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Profile{}, nil, err
+	}
+	return ProfileFromWeights(counts), unsupported, nil
+}
+
+// methodVariant returns the suffix of the generator variant that matches the
+// request params, such as #full for blocks with full transactions.
+func methodVariant(req loggedRequest) string {
+	switch req.Method {
+	case "eth_getBlockByNumber", "eth_getBlockByHash":
+		var params []json.RawMessage
+		if json.Unmarshal(req.Params, &params) == nil && len(params) > 1 && string(bytes.TrimSpace(params[1])) == "true" {
+			return "#full"
+		}
+	}
+	return ""
+}
+
+// parseLogLine extracts the requests from a log line, returning nil if there
+// are none.
+func parseLogLine(line []byte) []loggedRequest {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	if requests, ok := parseRequests(line); ok {
+		return requests
+	}
+
+	// nginx escapes quotes and other special characters in $request_body as \xHH
+	if bytes.Contains(line, []byte(`\x`)) {
+		line = unescapeNginx(line)
+	}
+	// Try every opening bracket, log lines can have others before the body
+	for start := bytes.IndexAny(line, "{["); start >= 0; {
+		var body json.RawMessage
+		if json.NewDecoder(bytes.NewReader(line[start:])).Decode(&body) == nil {
+			if requests, ok := parseRequests(body); ok {
+				return requests
+			}
+		}
+		next := bytes.IndexAny(line[start+1:], "{[")
+		if next < 0 {
+			break
+		}
+		start += next + 1
+	}
+	return nil
+}
+
+func parseRequests(body []byte) ([]loggedRequest, bool) {
+	if body[0] == '[' {
+		var batch []loggedRequest
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, false
+		}
+		return batch, true
+	}
+	var req loggedRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, false
+	}
+	return []loggedRequest{req}, true
+}
+
+func unescapeNginx(line []byte) []byte {
+	out := make([]byte, 0, len(line))
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+3 < len(line) && line[i+1] == 'x' {
+			if b, err := strconv.ParseUint(string(line[i+2:i+4]), 16, 8); err == nil {
+				out = append(out, byte(b))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, line[i])
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package ethspam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []string // methods with their variant
+	}{
+		{
+			name: "request",
+			line: `{"jsonrpc":"2.0","id":1,"method":"eth_blockNumber","params":[]}`,
+			want: []string{"eth_blockNumber"},
+		},
+		{
+			name: "batch",
+			line: `  [{"jsonrpc":"2.0","id":1,"method":"eth_chainId"},{"jsonrpc":"2.0","id":2,"method":"eth_getBlockByHash","params":["0xab", false]}]  `,
+			want: []string{"eth_chainId", "eth_getBlockByHash"},
+		},
+		{
+			name: "full blocks",
+			line: `[{"method":"eth_getBlockByNumber","params":["latest", true ]},{"method":"eth_getBlockByHash","params":["0xab",true]},{"method":"eth_getBlockByNumber","params":["latest"]}]`,
+			want: []string{"eth_getBlockByNumber#full", "eth_getBlockByHash#full", "eth_getBlockByNumber"},
+		},
+		{
+			name: "nginx",
+			line: `10.0.0.1 - - [16/Oct/2026:10:00:00 +0000] "POST / HTTP/1.1" 200 512 "-" "Go-http-client/1.1" {\x22jsonrpc\x22:\x222.0\x22,\x22id\x22:7,\x22method\x22:\x22eth_getBlockByNumber\x22,\x22params\x22:[\x22latest\x22,true]}`,
+			want: []string{"eth_getBlockByNumber#full"},
+		},
+		{
+			name: "nginx batch",
+			line: `10.0.0.1 - - [16/Oct/2026:10:00:00 +0000] "POST / HTTP/1.1" 200 512 [{\x22method\x22:\x22eth_call\x22,\x22params\x22:[{\x22to\x22:\x220xc02aaa39b223fe8d0a0e5c4f27ead9083c756cc2\x22},\x22latest\x22]},{\x22method\x22:\x22eth_gasPrice\x22}]`,
+			want: []string{"eth_call", "eth_gasPrice"},
+		},
+		{
+			name: "no body",
+			line: `10.0.0.1 - - [16/Oct/2026:10:00:00 +0000] "GET /health HTTP/1.1" 200 2 "-"`,
+		},
+		{
+			name: "empty",
+			line: "   ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, req := range parseLogLine([]byte(tt.line)) {
+				got = append(got, req.Method+methodVariant(req))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnescapeNginx(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`{\x22method\x22:\x22eth_call\x22}`, `{"method":"eth_call"}`},
+		{`a\x5Cb\x0a`, "a\\b\n"},
+		{`\xZZ stays`, `\xZZ stays`},
+		{`cut short \x2`, `cut short \x2`},
+		{`ends with \x22`, `ends with "`},
+		{`no escapes`, `no escapes`},
+	}
+	for _, tt := range tests {
+		if got := string(unescapeNginx([]byte(tt.line))); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package ethspam
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errTimeout = errors.New("timed out waiting for a response")
+
+var subscriptionKinds = map[string]bool{
+	"newHeads":               true,
+	"logs":                   true,
+	"newPendingTransactions": true,
+}
+
+// WSTarget sends generated queries over long-lived WebSocket connections, each
+// of which also holds eth_subscribe subscriptions. Query latencies and
+// notifications are recorded in Stats: newHeads notifications with their lag
+// behind the state, see SeenHead, other notifications with no latency.
+type WSTarget struct {
+	Endpoint      string
+	Connections   int
+	Timeout       time.Duration
+	Subscriptions []string
+	Stats         *Stats
+
+	// Contracts filter the logs subscriptions, each connection takes the
+	// next one in turn
+	Contracts []Contract
+
+	heads headClock
+}
+
+// NewWSTarget returns a WSTarget opening the given subscriptions, which are
+// any of newHeads, logs and newPendingTransactions, on every connection.
+func NewWSTarget(endpoint string, connections int, timeout time.Duration, subscriptions []string) (*WSTarget, error) {
+	for _, kind := range subscriptions {
+		if !subscriptionKinds[kind] {
+			return nil, errors.New(kind + " subscriptions are not supported")
+		}
+	}
+	return &WSTarget{
+		Endpoint:      endpoint,
+		Connections:   connections,
+		Timeout:       timeout,
+		Subscriptions: subscriptions,
+		Contracts:     popularContracts,
+	}, nil
+}
+
+// SeenHead records the current block of a new state. newHeads notifications
+// are timed against when the state first saw their block: the ones that come
+// in after are recorded with their lag, and the ones that come in before are
+// recorded under eth_subscription#newHeads/ahead with their lead, once the
+// state sees the block.
+func (t *WSTarget) SeenHead(block uint64) {
+	for _, lead := range t.heads.see(block, time.Now()) {
+		t.Stats.Record(headsAhead, lead, nil)
+	}
+}
+
+// Names of the newHeads notifications in Stats
+const (
+	headsBehind = "eth_subscription#newHeads"
+	headsAhead  = headsBehind + "/ahead"
+)
+
+// Run sends queries over the connections until the channel is closed or the
+// context is cancelled. Dropped connections are redialed.
+func (t *WSTarget) Run(ctx context.Context, queries <-chan QueryContent) {
+	var wg sync.WaitGroup
+	for i := 0; i < t.Connections; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			for {
+				err := t.session(ctx, n, queries)
+				if err == nil || ctx.Err() != nil {
+					return
+				}
+				t.Stats.Count("websocket", err)
+				select {
+				case <-time.After(time.Second):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// wsSession is the state of a single connection, shared by its writer and
+// reader.
+type wsSession struct {
+	target *WSTarget
+
+	mu            sync.Mutex
+	pending       map[int64]wsPending
+	subscriptions map[string]string // subscription id to kind
+
+	// done receives the id of every answered query
+	done chan int64
+}
+
+type wsPending struct {
+	query QueryContent
+	start time.Time
+}
+
+type wsMessage struct {
+	ID     *int64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *RPCError       `json:"error"`
+	Params *struct {
+		Subscription string          `json:"subscription"`
+		Result       json.RawMessage `json:"result"`
+	} `json:"params"`
+}
+
+// session runs a single connection, returning nil once the queries channel is
+// closed or the context is cancelled.
+func (t *WSTarget) session(ctx context.Context, n int, queries <-chan QueryContent) error {
+	dialer := websocket.Dialer{HandshakeTimeout: t.Timeout}
+	conn, _, err := dialer.DialContext(ctx, t.Endpoint, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s := &wsSession{
+		target:        t,
+		pending:       map[int64]wsPending{},
+		subscriptions: map[string]string{},
+		done:          make(chan int64, 1),
+	}
+
+	// The writer renders every query into the same buffer, which the
+	// connection copies from before WriteMessage returns
+	var body []byte
+
+	// Subscriptions use negative ids so they never collide with queries
+	for i, kind := range t.Subscriptions {
+		q := QueryContent{
+			Id:     -int64(i + 1),
+			Method: "eth_subscribe",
+			Params: t.subscribeParams(kind, n),
+			Name:   "eth_subscribe#" + kind,
+		}
+		s.track(q)
+		body = q.AppendBody(body[:0])
+		if err := conn.WriteMessage(websocket.TextMessage, body); err != nil {
+			return err
+		}
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.read(conn)
+	}()
+
+	for {
+		select {
+		case q, ok := <-queries:
+			if !ok {
+				return nil
+			}
+			s.track(q)
+			body = q.AppendBody(body[:0])
+			if err := conn.WriteMessage(websocket.TextMessage, body); err != nil {
+				return err
+			}
+			if err := s.wait(ctx, q, readErr); err != nil {
+				return err
+			}
+		case err := <-readErr:
+			return err
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *WSTarget) subscribeParams(kind string, n int) string {
+	if kind != "logs" || len(t.Contracts) == 0 {
+		return fmt.Sprintf(`["%s"]`, kind)
+	}
+	c := t.Contracts[n%len(t.Contracts)]
+	if len(c.Topics) == 0 {
+		return fmt.Sprintf(`["logs",{"address":"%s"}]`, c.Addr)
+	}
+	return fmt.Sprintf(`["logs",{"address":"%s","topics":["%s"]}]`, c.Addr, c.Topics[0])
+}
+
+func (s *wsSession) track(q QueryContent) {
+	s.mu.Lock()
+	s.pending[q.Id] = wsPending{query: q, start: time.Now()}
+	s.mu.Unlock()
+}
+
+// wait blocks until the query is answered or times out.
+func (s *wsSession) wait(ctx context.Context, q QueryContent, readErr <-chan error) error {
+	timeout := time.NewTimer(s.target.Timeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case id := <-s.done:
+			if id == q.Id {
+				return nil
+			}
+		case err := <-readErr:
+			return err
+		case <-timeout.C:
+			s.mu.Lock()
+			p, ok := s.pending[q.Id]
+			delete(s.pending, q.Id)
+			s.mu.Unlock()
+			if ok {
+				s.target.Stats.Record(p.query.Name, time.Since(p.start), errTimeout)
+				p.query.Answer(nil, errTimeout)
+			}
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// read handles incoming messages until the connection fails.
+func (s *wsSession) read(conn *websocket.Conn) error {
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var msg wsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return fmt.Errorf("failed to decode message: %s", err)
+		}
+		if msg.ID != nil {
+			s.response(*msg.ID, &msg)
+		} else if msg.Params != nil {
+			s.notification(msg.Params.Subscription, msg.Params.Result)
+		}
+	}
+}
+
+func (s *wsSession) response(id int64, msg *wsMessage) {
+	s.mu.Lock()
+	p, ok := s.pending[id]
+	delete(s.pending, id)
+	if ok && id < 0 && msg.Error == nil {
+		var subscription string
+		if json.Unmarshal(msg.Result, &subscription) == nil {
+			s.subscriptions[subscription] = strings.TrimPrefix(p.query.Name, "eth_subscribe#")
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		// Answered after timing out
+		return
+	}
+
+	var err error
+	if msg.Error != nil {
+		err = msg.Error
+	}
+	s.target.Stats.Record(p.query.Name, time.Since(p.start), err)
+	p.query.Answer(msg.Result, err)
+	if id >= 0 {
+		select {
+		case s.done <- id:
+		default:
+		}
+	}
+}
+
+func (s *wsSession) notification(subscription string, result json.RawMessage) {
+	s.mu.Lock()
+	kind, ok := s.subscriptions[subscription]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	name := "eth_subscription#" + kind
+	if kind != "newHeads" {
+		s.target.Stats.Count(name, nil)
+		return
+	}
+
+	var head struct {
+		Number string `json:"number"`
+	}
+	if err := json.Unmarshal(result, &head); err != nil {
+		s.target.Stats.Count(name, err)
+		return
+	}
+	number, _ := strconv.ParseUint(strings.TrimPrefix(head.Number, "0x"), 16, 64)
+	lag, ok, dropped := s.target.heads.notify(number, time.Now())
+	if ok {
+		s.target.Stats.Record(headsBehind, lag, nil)
+	}
+	for _, lead := range dropped {
+		s.target.Stats.Record(headsAhead, lead, nil)
+	}
+}
@@ -0,0 +1,51 @@
+package ethspam
+
+// weightedChoice picks indexes in proportion to their weights, for short
+// lists such as batch sizes or trace configs. Methods, of which there are
+// many, are picked by the alias table of QueriesGenerator instead.
+type weightedChoice struct {
+	weights     []int64
+	totalWeight int64
+}
+
+func (c *weightedChoice) add(weight int64) {
+	c.weights = append(c.weights, weight)
+	c.totalWeight += weight
+}
+
+// pick returns an index with a positive weight. It only draws a random
+// number if there is more than one index, so that fixed choices leave the
+// random stream alone.
+func (c weightedChoice) pick(draw func() int64) int {
+	if len(c.weights) == 1 {
+		return 0
+	}
+	r := draw() % c.totalWeight
+	for i, w := range c.weights {
+		if r < w {
+			return i
+		}
+		r -= w
+	}
+	return len(c.weights) - 1
+}
+
+// weightedParams are params fragments picked in proportion to their weights,
+// such as the trace configs of debug_trace* queries.
+type weightedParams struct {
+	params []string
+	choice weightedChoice
+}
+
+// add appends a fragment, unless its weight is zero.
+func (p *weightedParams) add(params string, weight int64) {
+	if weight == 0 {
+		return
+	}
+	p.params = append(p.params, params)
+	p.choice.add(weight)
+}
+
+func (p weightedParams) pick(s State) string {
+	return p.params[p.choice.pick(s.RandInt64)]
+}
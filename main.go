@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	ethspam "github.com/p2p-org/ethspam/lib"
 	"io"
+	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/INFURA/go-ethlibs/node"
@@ -20,12 +29,70 @@ var Version = "dev"
 // Options contains the flag options
 type Options struct {
 	Methods      map[string]int64 `short:"m" long:"method" description:"A map from json rpc methods to their weight" default:"eth_getCode:100" default:"eth_getLogs:250" default:"eth_getTransactionByHash:250" default:"eth_blockNumber:350" default:"eth_getTransactionCount:400" default:"eth_getBlockByNumber:400" default:"eth_getBalance:550" default:"eth_getTransactionReceipt:600" default:"eth_call:2000"`
-	Web3Endpoint string           `long:"rpc" description:"Ethereum JSONRPC provider, such as Infura or Cloudflare" default:"https://eth.drpc.org"` // Versus API key on Infura
+	Web3Endpoint string           `long:"rpc" description:"Ethereum JSONRPC provider, such as Infura or Cloudflare. With a WebSocket endpoint the state follows every new head" default:"https://eth.drpc.org"` // Versus API key on Infura
 	RateLimit    float64          `short:"r" long:"ratelimit" description:"rate limit for generating jsonrpc calls"`
+	Workers      int              `short:"w" long:"workers" description:"Number of goroutines generating queries, seeded streams are only reproducible with one" default:"1"`
+	Profile      string           `long:"profile" description:"JSON file with method weights and generator tunables, replaces --method"`
+	Contracts    string           `long:"contracts" description:"JSON file with contract and topic lists by chain ID, replaces the built-in list of the network"`
+
+	Keys   string `long:"keys" description:"File of funded hex private keys, one per line, to sign eth_sendRawTransaction transfers with. Nonces are tracked on --target when sending, otherwise on --rpc"`
+	RawTxs string `long:"raw-txs" description:"File of signed hex transactions, one per line, to replay as eth_sendRawTransaction"`
+
+	BatchSizes     map[int]int64 `long:"batch" description:"Group queries into JSONRPC batches, a map from batch size to its weight such as --batch 10:3 --batch 100:1"`
+	BatchPerMethod bool          `long:"batch-per-method" description:"Only group queries of the same method into a batch"`
+
+	Target      string        `long:"target" description:"Send the generated queries to this JSONRPC endpoint instead of printing them"`
+	Concurrency int           `short:"c" long:"concurrency" description:"Number of concurrent requests or connections when sending" default:"10"`
+	Timeout     time.Duration `long:"timeout" description:"Timeout for each request when sending" default:"10s"`
+	WSTarget    string        `long:"ws-target" description:"Send the generated queries over WebSocket connections to this endpoint, one connection per --concurrency"`
+	Subscribe   []string      `long:"subscribe" description:"Subscription to open on every --ws-target connection: newHeads, logs or newPendingTransactions"`
+	Compare     string        `long:"compare" description:"Also send every query to this JSONRPC endpoint and print the queries whose results differ from --target"`
+	Report      time.Duration `long:"report" description:"Interval for printing per-method results when sending, 0 to only print on exit" default:"10s"`
+
+	Metrics string `long:"metrics" description:"Serve Prometheus metrics on /metrics at this address, such as :9090"`
+
+	Seed   int64 `long:"seed" description:"Seed for the random source, 0 picks one from the current time"`
+	Freeze bool  `long:"freeze" description:"Keep the first state for the whole run instead of refreshing it, combine with --seed for a reproducible query stream"`
+
+	SaveState string `long:"save-state" description:"Write the state to this JSON file every time it is refreshed"`
+	LoadState string `long:"load-state" description:"Use the state from this JSON file instead of fetching it from --rpc, implies --freeze"`
+
+	FromBlock    *uint64 `long:"from-block" description:"Sample the state from past blocks starting at this one instead of following the latest block, for benchmarking archive nodes"`
+	ToBlock      uint64  `long:"to-block" description:"Last block of the sampled range, the latest block if unset"`
+	BlockCurve   float64 `long:"block-curve" description:"Shape of the sampling over the range: 1 is uniform, above 1 favors older blocks and below 1 recent ones" default:"1"`
+	SampleBlocks int     `long:"sample-blocks" description:"Number of blocks fetched from the range for hashes, transactions and addresses" default:"100"`
+
+	Synthetic          bool          `long:"synthetic" description:"Fabricate the state from --seed instead of fetching it, no endpoint is contacted"`
+	SyntheticHeight    uint64        `long:"synthetic-height" description:"Chain height of the synthetic state" default:"20000000"`
+	SyntheticBlockTime time.Duration `long:"synthetic-block-time" description:"Block time of the synthetic chain, 0 keeps it at --synthetic-height" default:"12s"`
+
+	WeightsFrom string `long:"weights-from" description:"Print a profile with method weights derived from a log of JSONRPC requests, one per line, and exit. Use - for stdin."`
 
 	Version bool `long:"version" description:"Print version and exit."`
 }
 
+// Queries buffered per worker between generation and output
+const queriesBuffer = 256
+
+// Output is written in large chunks, at least every flush interval
+const (
+	outputBuffer        = 1 << 20
+	outputFlushInterval = 100 * time.Millisecond
+)
+
+// The batcher is seeded apart from the workers, whose sources are seeded from
+// seed up, so that batch sizes don't replay their draws
+const batcherSeed = 0x5ca1ab1e
+
+// Pending nonces of the --keys accounts are fetched on this interval
+const walletSyncInterval = 5 * time.Second
+
+// stateBox holds the latest state, so that states of any type can be swapped
+// atomically
+type stateBox struct {
+	ethspam.State
+}
+
 func exit(code int, format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, args...)
 	os.Exit(code)
@@ -46,98 +113,565 @@ func main() {
 		os.Exit(0)
 	}
 
-	gen, err := ethspam.MakeQueriesGenerator(options.Methods)
-	if err != nil {
-		exit(1, "failed to install defaults: %s", err)
+	if options.WeightsFrom != "" {
+		if err := printWeights(options.WeightsFrom); err != nil {
+			exit(1, "failed to derive weights: %s", err)
+		}
+		os.Exit(0)
+	}
+
+	profile := ethspam.ProfileFromWeights(options.Methods)
+	if options.Profile != "" {
+		profile, err = loadProfile(options.Profile)
+		if err != nil {
+			exit(1, "failed to load profile: %s", err)
+		}
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	client, err := node.NewClient(ctx, options.Web3Endpoint)
+	sources := map[string]ethspam.Generator{}
+	if options.Keys != "" && options.RawTxs != "" {
+		exit(1, "--keys and --raw-txs can't be combined")
+	}
+	if options.Keys != "" {
+		endpoint := options.Web3Endpoint
+		if options.Target != "" {
+			endpoint = options.Target
+		}
+		wallet, client, err := loadWallet(ctx, options.Keys, endpoint)
+		if err != nil {
+			exit(1, "failed to set up the keys: %s", err)
+		}
+		wallet.Sending = options.Target != "" || options.WSTarget != ""
+		go syncWallet(ctx, wallet, client)
+		sources["eth_sendRawTransaction"] = wallet.Generate
+		sources["trace_rawTransaction"] = ethspam.TraceRawTransaction(wallet.RawTransaction, profile.Methods["trace_rawTransaction"])
+	}
+	if options.RawTxs != "" {
+		txs, err := loadRawTransactions(options.RawTxs)
+		if err != nil {
+			exit(1, "failed to load raw transactions: %s", err)
+		}
+		sources["eth_sendRawTransaction"] = txs.Generate
+		sources["trace_rawTransaction"] = ethspam.TraceRawTransaction(txs.RawTransaction, profile.Methods["trace_rawTransaction"])
+	}
+
+	gen, err := ethspam.MakeProfileQueriesGenerator(profile, sources)
 	if err != nil {
-		exit(1, "failed to make a new client: %s", err)
+		exit(1, "failed to install defaults: %s", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		cancel()
+		// Restore default handling so a second interrupt kills us
+		signal.Stop(sigCh)
+	}()
+
+	var stats *ethspam.Stats
+	var wsTarget *ethspam.WSTarget
+	if options.Workers < 1 {
+		exit(1, "workers must be at least 1")
 	}
-	mkState := ethspam.StateProducer{
-		Client: client,
+
+	sending := options.Target != "" || options.WSTarget != ""
+	if sending {
+		if options.Target != "" && options.WSTarget != "" {
+			exit(1, "--target and --ws-target can't be combined")
+		}
+		if options.Compare != "" && options.Target == "" {
+			exit(1, "--compare requires --target")
+		}
+		if len(options.BatchSizes) > 0 {
+			exit(1, "batches can only be printed, not sent")
+		}
+		if options.Concurrency < 1 {
+			exit(1, "concurrency must be at least 1")
+		}
+		stats = ethspam.NewStats()
+	}
+	if options.WSTarget != "" {
+		wsTarget, err = ethspam.NewWSTarget(options.WSTarget, options.Concurrency, options.Timeout, options.Subscribe)
+		if err != nil {
+			exit(1, "invalid subscriptions: %s", err)
+		}
+		wsTarget.Stats = stats
+	}
+
+	var metrics *ethspam.Metrics
+	if options.Metrics != "" {
+		metrics = ethspam.NewMetrics()
+		metrics.Stats = stats
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			if err := http.ListenAndServe(options.Metrics, mux); err != nil {
+				exit(1, "failed to serve metrics: %s", err)
+			}
+		}()
 	}
 
 	// stateChannel 😂
 	stateChannel := make(chan ethspam.State, 1)
 
 	// We don't need a high quality randomness source, just for benchmark shuffling
-	randSrc := rand.NewSource(time.Now().UnixNano())
-	go func() {
-		state := ethspam.LiveState{
-			IdGen:   &ethspam.IdGenerator{},
-			RandSrc: randSrc,
+	seed := options.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	randSrc := rand.NewSource(seed)
+
+	// Set even to 0, --from-block samples from genesis
+	historical := options.FromBlock != nil || options.ToBlock != 0
+	if historical && (options.LoadState != "" || options.SaveState != "") {
+		exit(1, "a historical range can't be combined with --load-state or --save-state")
+	}
+
+	if options.Synthetic && (historical || options.LoadState != "" || options.SaveState != "") {
+		exit(1, "--synthetic can't be combined with a historical range, --load-state or --save-state")
+	}
+
+	if options.Synthetic {
+		stateChannel <- ethspam.NewSyntheticState(seed, options.SyntheticHeight, options.SyntheticBlockTime)
+	} else if options.LoadState != "" {
+		// Loaded states are never refreshed, so no endpoint is needed
+		state, err := loadState(options.LoadState)
+		if err != nil {
+			exit(1, "failed to load state: %s", err)
 		}
-		for {
-			newState, err := mkState.Refresh(&state)
+		state.IdGen = &ethspam.IdGenerator{}
+		state.RandSrc = randSrc
+		state.OrphanedShare = profile.OrphanedShare
+		stateChannel <- state
+	} else {
+		client, err := node.NewClient(ctx, options.Web3Endpoint)
+		if err != nil {
+			exit(1, "failed to make a new client: %s", err)
+		}
+		contracts, err := networkContracts(ctx, client, options.Contracts)
+		if err != nil {
+			exit(1, "failed to pick contracts for the network: %s", err)
+		}
+		if historical {
+			mkHistory := ethspam.HistoryProducer{
+				Client:    client,
+				ToBlock:   options.ToBlock,
+				Curve:     options.BlockCurve,
+				Blocks:    options.SampleBlocks,
+				Contracts: contracts,
+			}
+			if options.FromBlock != nil {
+				mkHistory.FromBlock = *options.FromBlock
+			}
+			state, err := mkHistory.Produce(ctx, randSrc)
 			if err != nil {
-				// It can happen in some testnets that most of the blocks
-				// are empty(no transaction included), don't refresh the
-				// QueriesGenerator state without new inclusion.
-				if err == ethspam.ErrEmptyBlock {
-					select {
-					case <-time.After(5 * time.Second):
-					case <-ctx.Done():
-						return
-					}
-					continue
-				}
-				exit(2, "failed to refresh state")
+				exit(1, "failed to sample historical state: %s", err)
 			}
-			select {
-			case stateChannel <- newState:
-			case <-ctx.Done():
-				return
+			if metrics != nil {
+				metrics.Refreshed(state.LiveState)
 			}
-
-			select {
-			case <-time.After(15 * time.Second):
-			case <-ctx.Done():
+			stateChannel <- state
+		} else {
+			mkState := ethspam.StateProducer{
+				Client:         client,
+				TxPoolSize:     profile.TxPoolSize,
+				OrphanedShare:  profile.OrphanedShare,
+				ReceiptSamples: profile.ReceiptSamples,
+				Contracts:      contracts,
 			}
+			go refreshState(ctx, &mkState, time.Duration(profile.RefreshInterval), randSrc, stateChannel, options, metrics)
 		}
-	}()
+	}
 
 	var rlimit *rate.Limiter
 	if options.RateLimit != 0 {
 		rlimit = rate.NewLimiter(rate.Limit(options.RateLimit), 10)
 	}
-	state := <-stateChannel
-
-	queries := make(chan string)
-	
+	var state ethspam.State
+	select {
+	case state = <-stateChannel:
+	case <-ctx.Done():
+		return
+	}
+	if live, ok := state.(*ethspam.LiveState); ok && wsTarget != nil {
+		wsTarget.Contracts = live.Contracts()
+	}
+	if wsTarget != nil {
+		wsTarget.SeenHead(state.CurrentBlock())
+	}
 
+	// Workers pick up the latest state emitted, each generating from its own
+	// fork of it
+	var latest atomic.Value
+	latest.Store(&stateBox{state})
 	go func() {
-		defer close(queries)
 		for {
-			// Update state when a new one is emitted
 			select {
-			case state = <-stateChannel:
+			case state := <-stateChannel:
+				if wsTarget != nil {
+					wsTarget.SeenHead(state.CurrentBlock())
+				}
+				latest.Store(&stateBox{state})
 			case <-ctx.Done():
 				return
-			default:
 			}
-			if rlimit != nil {
-				rlimit.Wait(context.Background())
+		}
+	}()
+
+	queries := make(chan ethspam.QueryContent, options.Workers*queriesBuffer)
+	var workers sync.WaitGroup
+	for w := 0; w < options.Workers; w++ {
+		workers.Add(1)
+		go func(w int) {
+			defer workers.Done()
+			randSrc := rand.NewSource(seed + int64(w))
+			var box *stateBox
+			var state ethspam.State
+			for {
+				if b := latest.Load().(*stateBox); b != box {
+					box, state = b, b.Fork(randSrc)
+				}
+				if rlimit != nil {
+					rlimit.Wait(context.Background())
+				}
+				q, err := gen.Query(state)
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					exit(2, "failed to write generated query: %s", err)
+				}
+				if metrics != nil {
+					metrics.Generated(q.Name)
+				}
+				select {
+				case queries <- q:
+				case <-ctx.Done():
+					return
+				}
 			}
-			if q, err := gen.Query(state); err == io.EOF {
-				return
-			} else if err != nil {
-				exit(2, "failed to write generated query: %s", err)
+		}(w)
+	}
+	go func() {
+		workers.Wait()
+		close(queries)
+	}()
+
+	if sending {
+		if options.Report > 0 {
+			go reportStats(ctx, stats, options.Report)
+		}
+		if wsTarget != nil {
+			wsTarget.Run(ctx, queries)
+			stats.WriteTable(os.Stderr)
+			return
+		}
+
+		driver := ethspam.Driver{
+			Target:      ethspam.NewTarget(options.Target, options.Concurrency, options.Timeout),
+			Concurrency: options.Concurrency,
+			Stats:       stats,
+		}
+		if options.Compare != "" {
+			// Mismatches go to stdout as JSON lines, which is otherwise unused while sending
+			driver.Compare = ethspam.NewTarget(options.Compare, options.Concurrency, options.Timeout)
+			driver.Comparison = ethspam.NewComparison(os.Stdout)
+		}
+		runErr := driver.Run(ctx, queries)
+		stats.WriteTable(os.Stderr)
+		if driver.Comparison != nil {
+			fmt.Fprintln(os.Stderr)
+			driver.Comparison.WriteTable(os.Stderr)
+		}
+		if runErr != nil {
+			exit(2, "failed to write mismatch: %s", runErr)
+		}
+		return
+	}
+
+	var batcher *ethspam.Batcher
+	if len(options.BatchSizes) > 0 {
+		batcher, err = ethspam.NewBatcher(options.BatchSizes, options.BatchPerMethod, rand.NewSource(seed^batcherSeed))
+		if err != nil {
+			exit(1, "invalid batch sizes: %s", err)
+		}
+	}
+
+	if err := printQueries(os.Stdout, queries, batcher); err != nil && err != io.EOF {
+		exit(2, "failed to write generated query: %s", err)
+	}
+}
+
+// printQueries writes the queries, or their batches, through a large buffer
+// until the channel is closed. The buffer is flushed periodically so that
+// slow, rate limited streams still show up promptly.
+func printQueries(w io.Writer, queries <-chan ethspam.QueryContent, batcher *ethspam.Batcher) error {
+	out := bufio.NewWriterSize(w, outputBuffer)
+	ticker := time.NewTicker(outputFlushInterval)
+	defer ticker.Stop()
+
+	var body []byte
+	for {
+		select {
+		case query, ok := <-queries:
+			if !ok {
+				if batcher != nil {
+					for _, batch := range batcher.Flush() {
+						body = batch.AppendBody(body[:0])
+						if _, err := out.Write(body); err != nil {
+							return err
+						}
+					}
+				}
+				return out.Flush()
+			}
+			// Nothing answers printed queries, sessions carry on without
+			// responses
+			query.Answer(nil, nil)
+			if batcher == nil {
+				body = query.AppendBody(body[:0])
+			} else if batch := batcher.Add(query); batch != nil {
+				body = batch.AppendBody(body[:0])
 			} else {
-				queries <- q.GetBody()
+				continue
+			}
+			if _, err := out.Write(body); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if err := out.Flush(); err != nil {
+				return err
 			}
 		}
-	}()
+	}
+}
+
+// reportStats prints the stats table on every interval until the context is
+// cancelled.
+func reportStats(ctx context.Context, stats *ethspam.Stats, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stats.WriteTable(os.Stderr)
+			fmt.Fprintln(os.Stderr)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refreshState emits a fresh state for every new head, or on every refresh
+// interval when heads can't be followed, until the context is cancelled.
+func refreshState(ctx context.Context, mkState *ethspam.StateProducer, interval time.Duration, randSrc rand.Source, stateChannel chan<- ethspam.State, options Options, metrics *ethspam.Metrics) {
+	state := &ethspam.LiveState{
+		IdGen:   &ethspam.IdGenerator{},
+		RandSrc: randSrc,
+	}
+	heads := ethspam.NewHeadFollower(ctx, mkState.Client, interval)
+	for {
+		newState, err := mkState.Refresh(state)
+		if err != nil {
+			// It can happen in some testnets that most of the blocks
+			// are empty(no transaction included), don't refresh the
+			// QueriesGenerator state without new inclusion.
+			if err == ethspam.ErrEmptyBlock || err == ethspam.ErrSameHead {
+				if metrics != nil && err == ethspam.ErrEmptyBlock {
+					metrics.EmptyBlock()
+				}
+				heads.Wait(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			exit(2, "failed to refresh state")
+		}
+		state = newState
+		heads.Observe(state.CurrentBlock())
+		if metrics != nil {
+			metrics.Refreshed(newState)
+		}
+		if options.SaveState != "" {
+			if err := saveState(options.SaveState, newState); err != nil {
+				exit(2, "failed to save state: %s", err)
+			}
+		}
+		select {
+		case stateChannel <- newState:
+		case <-ctx.Done():
+			return
+		}
+		if options.Freeze {
+			return
+		}
 
-	for query := range queries {
-		if _, err := fmt.Fprint(os.Stdout, query); err == io.EOF {
+		// A failed subscription falls back to polling on the next wait
+		heads.Wait(ctx)
+		if ctx.Err() != nil {
 			return
-		} else if err != nil {
-			exit(2, "failed to write generated query: %s", err)
 		}
 	}
 }
+
+// saveState writes the state to a temporary file next to path and renames it
+// over path, so an interrupted save never leaves a truncated snapshot.
+func saveState(path string, state *ethspam.LiveState) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if err := state.Save(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// printWeights writes a profile derived from the traffic log to stdout, and
+// lists the methods ethspam can't generate on stderr.
+func printWeights(path string) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	profile, unsupported, err := ethspam.ProfileFromLog(in)
+	if err != nil {
+		return err
+	}
+	if len(profile.Methods) == 0 {
+		return errors.New("no supported methods found in the log")
+	}
+	for method, count := range unsupported {
+		fmt.Fprintf(os.Stderr, "skipping unsupported method %s (%d requests)\n", method, count)
+	}
+	out, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", out)
+	return err
+}
+
+func loadProfile(path string) (ethspam.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ethspam.Profile{}, err
+	}
+	defer f.Close()
+	return ethspam.LoadProfile(f)
+}
+
+// networkContracts returns the contracts for the chain of the endpoint, from
+// the file if it has a list for the chain, otherwise the built-in one.
+func networkContracts(ctx context.Context, client node.Client, path string) ([]ethspam.Contract, error) {
+	chainID, err := ethspam.ChainID(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		lists, err := ethspam.LoadContracts(f)
+		if err != nil {
+			return nil, err
+		}
+		if contracts, ok := lists[chainID]; ok {
+			return contracts, nil
+		}
+	}
+	contracts := ethspam.NetworkContracts(chainID)
+	if contracts == nil {
+		fmt.Fprintf(os.Stderr, "no contract list for chain %d, using mainnet contracts until active ones are discovered\n", chainID)
+	}
+	return contracts, nil
+}
+
+// loadWallet reads the keys and signs for the chain of the endpoint, with its
+// current gas price bumped by a fifth so transfers aren't priced out by the
+// time they land.
+func loadWallet(ctx context.Context, path string, endpoint string) (*ethspam.Wallet, node.Client, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	keys, err := ethspam.ReadLines(f)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	client, err := node.NewClient(ctx, endpoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	chainID, err := ethspam.ChainID(ctx, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	gasPrice, err := ethspam.GasPrice(ctx, client)
+	if err != nil {
+		return nil, nil, err
+	}
+	wallet, err := ethspam.NewWallet(keys, chainID, gasPrice+gasPrice/5)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := wallet.Sync(ctx, client); err != nil {
+		return nil, nil, err
+	}
+	return wallet, client, nil
+}
+
+// syncWallet keeps the nonces of the wallet in line with the pending nonces of
+// the endpoint until the context is cancelled. Failed syncs are retried on the
+// next interval.
+func syncWallet(ctx context.Context, wallet *ethspam.Wallet, client node.Client) {
+	ticker := time.NewTicker(walletSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := wallet.Sync(ctx, client); err != nil && ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "failed to sync nonces: %s\n", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func loadRawTransactions(path string) (*ethspam.RawTransactions, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ethspam.LoadRawTransactions(f)
+}
+
+func loadState(path string) (*ethspam.LiveState, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ethspam.LoadState(f)
+}